@@ -0,0 +1,61 @@
+package work
+
+import "sync"
+
+// Barrier coordinates a flush across a group of batches - e.g. a stream sharded across several batches that needs a
+// consistent checkpoint across all of them before advancing a global offset
+type Barrier struct {
+	batches map[*Batch]bool
+	mutex   sync.Mutex
+}
+
+func NewBarrier() *Barrier {
+	return &Barrier{
+		batches: make(map[*Batch]bool),
+	}
+}
+
+// JoinBarrier adds the batch to the barrier, so it is flushed whenever the barrier is
+func (b *Batch) JoinBarrier(barrier *Barrier) {
+	barrier.mutex.Lock()
+	barrier.batches[b] = true
+	barrier.mutex.Unlock()
+}
+
+// LeaveBarrier removes the batch from the barrier
+func (b *Batch) LeaveBarrier(barrier *Barrier) {
+	barrier.mutex.Lock()
+	delete(barrier.batches, b)
+	barrier.mutex.Unlock()
+}
+
+// Flush flushes every joined batch concurrently, returning once all of them have completed.  Batches joining or
+// leaving during the flush don't affect it - it applies to the batches joined when it started.  Any errors are
+// aggregated into a MultiError.  Batches that have already been closed are skipped, as closing flushed them.
+func (br *Barrier) Flush() error {
+	br.mutex.Lock()
+	batches := make([]*Batch, 0, len(br.batches))
+	for b := range br.batches {
+		batches = append(batches, b)
+	}
+	br.mutex.Unlock()
+
+	var errs MultiError
+	var errsMutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(batches))
+
+	for _, b := range batches {
+		go func(b *Batch) {
+			defer wg.Done()
+			if err := b.Flush(); err != nil && err != ErrBatchClosed {
+				errsMutex.Lock()
+				errs = append(errs, err)
+				errsMutex.Unlock()
+			}
+		}(b)
+	}
+
+	wg.Wait()
+	return errs.errorOrNil()
+}
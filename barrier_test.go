@@ -0,0 +1,44 @@
+package work
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBarrier_Flush(t *testing.T) {
+	var flushed int32
+	handler := func(i []interface{}) error {
+		atomic.AddInt32(&flushed, int32(len(i)))
+		return nil
+	}
+
+	barrier := NewBarrier()
+	b1 := NewBatch(10, handler)
+	b2 := NewBatch(10, handler)
+	b3 := NewBatch(10, func(i []interface{}) error {
+		return errors.New("failed")
+	})
+	b1.JoinBarrier(barrier)
+	b2.JoinBarrier(barrier)
+	b3.JoinBarrier(barrier)
+
+	for _, b := range []*Batch{b1, b2, b3} {
+		if err := b.Push(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := barrier.Flush()
+	if multi, ok := err.(MultiError); !ok || len(multi) != 1 {
+		t.Fatal("expected a single aggregated error")
+	}
+	if atomic.LoadInt32(&flushed) != 2 {
+		t.Fatal("joined batches were not flushed")
+	}
+
+	b3.LeaveBarrier(barrier)
+	if err := barrier.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
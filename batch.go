@@ -1,19 +1,131 @@
 package work
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 type Batch struct {
-	batchPosition int
-	batchSize     int
-	itemsToSave   []interface{}
-	pushHandler   BatchHandler
-	flushHandler  BatchHandler
-	mutex         *sync.Mutex
+	batchPosition  int
+	batchSize      int
+	itemsToSave    []interface{}
+	pushHandler    BatchHandler
+	flushHandler   BatchHandler
+	mutex          *sync.Mutex
+	closed         bool
+	closedPolicy   ClosedPolicy
+	discardOnClose bool
+	dropped        int64
+
+	// pausing, during which pushes are buffered without calling handlers
+	paused      bool
+	pauseLimit  int
+	pausePolicy PauseOverflowPolicy
+	pauseCond   *sync.Cond
+
+	// time-based behavior
+	flushInterval time.Duration
+	enqueued      []time.Time // when each buffered record was pushed, parallel to itemsToSave
+	manualClock   bool
+	manualNow     time.Time
+	timerStop     chan bool
+	onError       func(error)
+
+	// forced closing once the batch reaches its maximum lifetime
+	deadline      time.Time
+	lifetimeTimer *time.Timer
+	onClosed      func()
+
+	// sequence number of the last batch handed to a handler
+	seq int
+
+	// applied to each batch before it's handed to a handler
+	batchTransform func([]interface{}) ([]interface{}, error)
+
+	// retrying failed handler calls
+	newBackoff func() Backoff
+	ctx        context.Context
+
+	// optional ordering assertion, for catching reordering bugs during development
+	assertOrder func(prev, next interface{}) bool
+	last        interface{}
+	hasLast     bool
+
+	// diversion of batches away from a slow primary handler
+	slowThreshold  time.Duration
+	slowHandler    BatchHandler
+	slowSampleRate float64
+	slowLatency    time.Duration
+	slowDiverted   int
+
+	// deduplication of buffered records
+	dedupKey   func(interface{}) string
+	dedupEqual func(a, b interface{}) bool
+	dedupIndex map[string]int
+
+	// ring buffer of recently-handled batches, for diagnostics
+	retainRecent int
+	recent       [][]interface{}
+	recentNext   int
+
+	// grouping of handler calls into downstream transactions
+	commitMutex sync.Mutex
+	commitEvery int
+	commit      func() error
+	rollback    func() error
+	uncommitted int
+	groupTx     Tx
+	groupTokens []interface{}
+
+	// whether PushSlice stops at the first failure
+	bulkAtomic bool
+
+	// consulted before each batch is handed to a handler, and the batches it delayed (with the timers releasing them)
+	preFlushHook func([]interface{}) FlushAction
+	held         []heldBatch
+	heldTimers   map[*time.Timer]bool
+
+	// sampled handler call durations, for percentiles
+	latencyTracking int32
+	latencies       []time.Duration
+	latencyCount    int64
+
+	// holds a loggerHolder, once a logger is set
+	logger atomic.Value
+
+	// custom management of buffer memory
+	alloc   func(n int) []interface{}
+	release func([]interface{})
+
+	// acknowledgement of records pushed with a token, once their batch has been handled
+	ack       func(tokens []interface{}) error
+	hasTokens bool
+	tokens    []interface{}
+
+	// handler errors tolerated as warnings, and when the recent ones happened
+	maxErrors       int
+	toleranceWindow time.Duration
+	recentErrors    []time.Time
 }
 
+// ClosedPolicy determines what Push does with records that arrive after the batch is closed
+type ClosedPolicy int
+
+const (
+	// ErrorOnClosed makes Push return ErrBatchClosed (the default)
+	ErrorOnClosed ClosedPolicy = iota
+
+	// DropOnClosed makes Push silently discard the record, incrementing the dropped count
+	DropOnClosed
+)
+
+// ErrBatchClosed is returned when pushing to (or flushing) a batch that has been closed
+var ErrBatchClosed = errors.New("batch closed")
+
 // BatchSource is a convenience interface - not used directly by this module
 type BatchSource interface {
 	// when the caller wants to process slices of data
@@ -58,10 +170,41 @@ type BatchHandler func([]interface{}) error
 
 func NewBatch(batchSize int, pushHandler BatchHandler, flushHandler ...BatchHandler) *Batch {
 	b := Batch{}
-	b.Init(batchSize,  pushHandler, flushHandler...)
+	b.Init(batchSize, pushHandler, flushHandler...)
 	return &b
 }
 
+// NewChannelBatch creates a batch that sends each full (or flushed) batch to ch instead of calling a handler.  Sends
+// happen on the goroutine calling Push/Flush/Close, so an unbuffered (or full) channel blocks producers until a receiver
+// takes the batch - size the channel buffer for how far producers may run ahead.  After Close, nothing more is sent; the
+// caller owns ch and is responsible for closing it.
+func NewChannelBatch(batchSize int, ch chan<- []interface{}) *Batch {
+	return NewBatch(batchSize, func(i []interface{}) error {
+		ch <- i
+		return nil
+	})
+}
+
+// NewCollectorBatch creates a batch whose handler collects everything it's handed, for asserting on in tests - the
+// returned function gives a copy of every record handled so far (i.e. up to the last flush), in order
+func NewCollectorBatch(batchSize int) (*Batch, func() []interface{}) {
+	var mutex sync.Mutex
+	var collected []interface{}
+
+	b := NewBatch(batchSize, func(i []interface{}) error {
+		mutex.Lock()
+		collected = append(collected, i...)
+		mutex.Unlock()
+		return nil
+	})
+
+	return b, func() []interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]interface{}(nil), collected...)
+	}
+}
+
 func (b *Batch) Init(batchSize int, pushHandler BatchHandler, flushHandler ...BatchHandler) {
 	b.batchPosition = 0
 
@@ -79,40 +222,75 @@ func (b *Batch) Init(batchSize int, pushHandler BatchHandler, flushHandler ...Ba
 	}
 
 	b.mutex = &sync.Mutex{}
+	b.pauseCond = sync.NewCond(b.mutex)
 }
 
 func (b *Batch) Push(record interface{}) error {
+	return b.push(record, nil, false)
+}
+
+// push adds the record to the batch, carrying its ack token, if it has one
+func (b *Batch) push(record interface{}, token interface{}, hasToken bool) error {
 	if b.batchSize == 0 {
 		return errors.New("batch not initialized")
 	}
 
-	// if only one item is in the batch, don't even bother storing it
-	if b.batchSize == 1 {
-		return b.pushHandler([]interface{}{record})
-	}
-
 	// lock around batch processing
 	b.mutex.Lock()
+	if hasToken {
+		b.trackTokensLocked()
+	}
 
-	// allocate the buffer of items to save, if needed
-	if b.itemsToSave == nil {
-		b.itemsToSave = make([]interface{}, b.batchSize, b.batchSize)
+	// while paused, wait (or fail) once the overflow limit is reached
+	if err := b.waitForPauseOverflow(); err != nil {
+		b.mutex.Unlock()
+		return err
+	}
+
+	// late pushes either error or get dropped, depending on the configured policy
+	if b.closed {
+		err := b.rejectClosed()
+		b.mutex.Unlock()
+		return err
+	}
+
+	if b.assertOrder != nil {
+		b.checkOrder(record)
+	}
+
+	// a duplicate replaces the buffered record it duplicates
+	key, replaced := b.dedupLocked(record)
+	if replaced >= 0 {
+		b.mergeTokenLocked(replaced, token)
+		b.mutex.Unlock()
+		return nil
+	}
+
+	// while paused, everything is buffered, regardless of batch size
+	if b.paused {
+		b.appendLocked(record, key, token)
+		b.mutex.Unlock()
+		return nil
+	}
+
+	// if only one item is in the batch, don't even bother storing it
+	if b.batchSize == 1 {
+		b.mutex.Unlock()
+		return b.callOwned(b.pushHandler, []interface{}{record}, false, []interface{}{token})
 	}
 
 	// if our batch is full
 	if b.batchPosition >= b.batchSize {
-		batch := b.itemsToSave
 
-		// allocate a new buffer, put the inbound record as the first item
-		b.itemsToSave = make([]interface{}, b.batchSize, b.batchSize)
-		b.itemsToSave[0] = record
-		b.batchPosition = 1
+		// take the full buffer, put the inbound record as the first item of a new one
+		batch, tokens := b.takeLocked()
+		b.appendLocked(record, key, token)
 
 		// release the lock
 		b.mutex.Unlock()
 
 		// TODO: review impact of making this call from a goroutine - definitely faster, but would bugs arise from timing changes?
-		if err := b.pushHandler(batch); err != nil {
+		if err := b.callBuffer(b.pushHandler, batch, tokens); err != nil {
 			return err
 		}
 
@@ -120,14 +298,36 @@ func (b *Batch) Push(record interface{}) error {
 	} else {
 
 		// our batch is not full - if the batch size
-		b.itemsToSave[b.batchPosition] = record
-		b.batchPosition++
+		b.appendLocked(record, key, token)
 		b.mutex.Unlock()
 	}
 
 	return nil
 }
 
+// appendLocked adds the record to the buffer, growing it beyond the batch size if needed (which only happens while
+// paused), and indexes its dedup key - the caller must hold the lock
+func (b *Batch) appendLocked(record interface{}, key string, token interface{}) {
+
+	// allocate the buffer of items to save, if needed
+	if b.itemsToSave == nil {
+		b.itemsToSave = b.allocBuffer(b.batchSize)
+	}
+
+	b.enqueued = append(b.enqueued[:b.batchPosition], b.now())
+
+	if b.batchPosition >= len(b.itemsToSave) {
+		b.growLocked()
+	}
+	b.itemsToSave[b.batchPosition] = record
+	b.appendTokenLocked(token)
+	b.batchPosition++
+
+	if b.dedupKey != nil {
+		b.dedupIndex[key] = b.batchPosition - 1
+	}
+}
+
 func (b *Batch) GetPosition() int {
 	b.mutex.Lock()
 	pos := b.batchPosition
@@ -135,6 +335,45 @@ func (b *Batch) GetPosition() int {
 	return pos
 }
 
+// BatchStatus is a consistent snapshot of a batch's state, for monitoring
+type BatchStatus struct {
+	Used      int
+	Cap       int
+	OldestAge time.Duration
+	Closed    bool
+}
+
+// Snapshot returns the batch's state, taken in a single lock acquisition - OldestAge is how long the oldest buffered
+// record has been waiting (zero when the batch is empty)
+func (b *Batch) Snapshot() BatchStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := BatchStatus{
+		Used:   b.batchPosition,
+		Cap:    b.batchSize,
+		Closed: b.closed,
+	}
+	if b.batchPosition > 0 {
+		status.OldestAge = b.now().Sub(b.enqueued[0])
+	}
+	return status
+}
+
+// EstimateBytes estimates the memory held by the buffer, for capacity planning - sizeOf is summed over the buffered
+// records, plus the overhead of the buffer itself (and its per-record bookkeeping).  It's a read-only diagnostic, taken
+// under the lock, so sizeOf should be cheap.
+func (b *Batch) EstimateBytes(sizeOf func(interface{}) int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	total := cap(b.itemsToSave)*int(unsafe.Sizeof(interface{}(nil))) + cap(b.enqueued)*int(unsafe.Sizeof(time.Time{}))
+	for i := 0; i < b.batchPosition; i++ {
+		total += sizeOf(b.itemsToSave[i])
+	}
+	return total
+}
+
 func (b *Batch) Flush() error {
 	if b.batchSize == 0 {
 		return errors.New("batch not initialized")
@@ -142,22 +381,328 @@ func (b *Batch) Flush() error {
 
 	// lock around batch processing
 	b.mutex.Lock()
-	if b.batchPosition > 0 {
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrBatchClosed
+	}
 
-		// snag the rest of the buffer as a slice, reset buffer
-		subSlice := (b.itemsToSave)[0:b.batchPosition]
-		b.itemsToSave = make([]interface{}, b.batchSize, b.batchSize)
-		b.batchPosition = 0
+	// hold everything while paused
+	if b.paused {
+		b.mutex.Unlock()
+		return nil
+	}
+
+	return b.flushLocked()
+}
+
+// flushLocked hands whatever is buffered to the flush handler - the caller must hold the lock, which is released
+func (b *Batch) flushLocked() error {
+	subSlice, tokens := b.takeLocked()
+
+	// we've finished batch processing, unlock
+	b.mutex.Unlock()
+
+	if subSlice == nil {
+		return nil
+	}
+
+	// call the configured flush handler
+	return b.callBuffer(b.flushHandler, subSlice, tokens)
+}
+
+// takeLocked removes everything buffered, returning it (or nil, if nothing is buffered) along with the records' ack
+// tokens - the caller must hold the lock
+func (b *Batch) takeLocked() ([]interface{}, []interface{}) {
+	if b.batchPosition == 0 {
+		return nil, nil
+	}
+
+	// snag the rest of the buffer as a slice, reset buffer
+	subSlice := (b.itemsToSave)[0:b.batchPosition]
+	tokens := b.takeTokensLocked(0, b.batchPosition)
+	b.tokens = nil
+	b.itemsToSave = b.allocBuffer(b.batchSize)
+	b.batchPosition = 0
+	b.reindexLocked()
+	return subSlice, tokens
+}
+
+// FlushReturn is Flush, but also returns the records handed to the flush handler (e.g. to pull the max offset from the
+// last one for a checkpoint).  The returned slice is a copy taken before the handler runs, so it's safe to read
+// regardless of what the handler does with its slice.
+func (b *Batch) FlushReturn() ([]interface{}, error) {
+	if b.batchSize == 0 {
+		return nil, errors.New("batch not initialized")
+	}
 
-		// we've finished batch processing, unlock
+	b.mutex.Lock()
+	if b.closed {
 		b.mutex.Unlock()
+		return nil, ErrBatchClosed
+	}
 
-		// call the configured flush handler
-		err := b.flushHandler(subSlice)
-		subSlice = nil
-		return err
+	if b.paused {
+		b.mutex.Unlock()
+		return nil, nil
 	}
+
+	subSlice, tokens := b.takeLocked()
 	b.mutex.Unlock()
 
-	return nil
+	if subSlice == nil {
+		return nil, nil
+	}
+
+	processed := append([]interface{}(nil), subSlice...)
+	return processed, b.callBuffer(b.flushHandler, subSlice, tokens)
+}
+
+// FlushOlderThan hands the flush handler only the records pushed before cutoff, leaving newer ones buffered in their
+// original order - for sliding windows, where the tail of the window is committed while the head keeps accumulating.
+// It returns the number of records flushed.
+func (b *Batch) FlushOlderThan(cutoff time.Time) (int, error) {
+	if b.batchSize == 0 {
+		return 0, errors.New("batch not initialized")
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return 0, ErrBatchClosed
+	}
+
+	if b.paused {
+		b.mutex.Unlock()
+		return 0, nil
+	}
+
+	// the buffer was never handed out, so the records we keep can be compacted in place
+	var older, olderTokens []interface{}
+	kept := 0
+	for i := 0; i < b.batchPosition; i++ {
+		if b.enqueued[i].Before(cutoff) {
+			older = append(older, b.itemsToSave[i])
+			if b.hasTokens {
+				olderTokens = append(olderTokens, b.tokens[i])
+			}
+			continue
+		}
+		b.itemsToSave[kept] = b.itemsToSave[i]
+		b.enqueued[kept] = b.enqueued[i]
+		if b.hasTokens {
+			b.tokens[kept] = b.tokens[i]
+		}
+		kept++
+	}
+	for i := kept; i < b.batchPosition; i++ {
+		b.itemsToSave[i] = nil
+	}
+	if b.hasTokens {
+		b.tokens = b.tokens[:kept]
+	}
+	b.batchPosition = kept
+	b.reindexLocked()
+	b.mutex.Unlock()
+
+	if len(older) == 0 {
+		return 0, nil
+	}
+	return len(older), b.callOwned(b.flushHandler, older, false, olderTokens)
+}
+
+// SetClosedPolicy configures how Push treats records that arrive after Close - the default is ErrorOnClosed
+func (b *Batch) SetClosedPolicy(policy ClosedPolicy) {
+	b.mutex.Lock()
+	b.closedPolicy = policy
+	b.mutex.Unlock()
+}
+
+// GetDropped returns how many records were discarded, either because they were pushed after Close under DropOnClosed,
+// or because the pre-flush hook dropped their batch
+func (b *Batch) GetDropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// Close flushes anything remaining in the batch (unless SetDiscardOnClose was used), then marks it closed so subsequent
+// pushes are rejected (or dropped)
+func (b *Batch) Close() error {
+	if b.batchSize == 0 {
+		return errors.New("batch not initialized")
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.stopTimer()
+	b.stopLifetimeTimer()
+	b.stopHeldTimersLocked()
+	if onClosed := b.onClosed; onClosed != nil {
+		defer onClosed()
+	}
+
+	// closing resumes a paused batch, so everything buffered is delivered
+	b.paused = false
+	b.pauseCond.Broadcast()
+
+	// speculative batches throw away whatever is left
+	if b.discardOnClose {
+		b.logf("batch closing, discarding %d buffered records", b.batchPosition)
+		b.releaseBufferLocked(b.itemsToSave)
+		b.discardHeldLocked()
+		b.itemsToSave = nil
+		b.tokens = nil
+		b.batchPosition = 0
+		b.reindexLocked()
+		b.mutex.Unlock()
+		return b.commitPending()
+	}
+
+	b.logf("batch closing, flushing %d buffered records", b.batchPosition)
+	overflow, tokens := b.takeOverflowLocked()
+	b.mutex.Unlock()
+
+	var errs MultiError
+	if err := b.callEach(b.pushHandler, overflow, tokens); err != nil {
+		errs = append(errs, err)
+	}
+
+	b.mutex.Lock()
+	if err := b.flushLocked(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := b.deliverHeld(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := b.commitPending(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.errorOrNil()
+}
+
+// SetDiscardOnClose makes Close throw away anything still buffered instead of flushing it - e.g. for a speculative
+// batch whose partial data shouldn't be kept.  Close still stops any background work and marks the batch closed.
+func (b *Batch) SetDiscardOnClose(discard bool) {
+	b.mutex.Lock()
+	b.discardOnClose = discard
+	b.mutex.Unlock()
+}
+
+// rejectClosed applies the closed policy to a late push - the caller must hold the lock
+func (b *Batch) rejectClosed() error {
+	if b.closedPolicy == DropOnClosed {
+		atomic.AddInt64(&b.dropped, 1)
+		return nil
+	}
+	return ErrBatchClosed
+}
+
+// SetBatchTransform sets a function applied to each whole batch (sorting it, compacting it, attaching a batch-level
+// header, etc.) just before it's handed to the push or flush handler.  It runs outside the lock, and an error from it is
+// treated like a handler error.
+func (b *Batch) SetBatchTransform(transform func([]interface{}) ([]interface{}, error)) {
+	b.mutex.Lock()
+	b.batchTransform = transform
+	b.mutex.Unlock()
+}
+
+// call hands a batch of records to the given handler, along with any bookkeeping configured for the batch
+func (b *Batch) call(handler BatchHandler, items []interface{}) error {
+	return b.callOwned(handler, items, false, nil)
+}
+
+// callBuffer is call for a batch that's a whole buffer, which is released once the batch has been handled (or dropped),
+// acknowledging the records' tokens once it's been handled successfully
+func (b *Batch) callBuffer(handler BatchHandler, items []interface{}, tokens []interface{}) error {
+	return b.callOwned(handler, items, true, tokens)
+}
+
+// callOwned does the work of call and callBuffer, releasing items' buffer afterwards if the batch owns it
+func (b *Batch) callOwned(handler BatchHandler, items []interface{}, owned bool, tokens []interface{}) error {
+	if !b.preFlush(handler, items, owned, tokens) {
+		return nil
+	}
+
+	err := b.deliver(handler, items, tokens)
+	if owned {
+		b.releaseBuffer(items)
+	}
+	return err
+}
+
+// deliver does the work of call once the pre-flush hook has let the batch through, acknowledging the records' tokens
+// once the batch (or, when grouping, its group) has been handled
+func (b *Batch) deliver(handler BatchHandler, items []interface{}, tokens []interface{}) error {
+	b.mutex.Lock()
+	b.seq++
+	seq := b.seq
+	b.mutex.Unlock()
+
+	err := b.callSeq(handler, items)
+	if err != nil {
+		err = &BatchError{Seq: seq, Time: time.Now(), Len: len(items), Err: err}
+
+		// a tolerated failure counts as handled, so it doesn't roll back its group, but its records aren't acknowledged
+		if b.tolerate(err) {
+			return b.completeGroup(nil, nil)
+		}
+	}
+	return b.completeGroup(err, tokens)
+}
+
+// callSeq does the work of deliver, returning errors unwrapped
+func (b *Batch) callSeq(handler BatchHandler, items []interface{}) error {
+	b.mutex.Lock()
+	transform := b.batchTransform
+	newBackoff := b.newBackoff
+	ctx := b.ctx
+	b.mutex.Unlock()
+
+	// shape the batch before anything else sees it
+	if transform != nil {
+		var err error
+		if items, err = transform(items); err != nil {
+			return err
+		}
+	}
+
+	b.retain(items)
+
+	handler, primary := b.route(handler)
+
+	var backoff Backoff
+	for {
+		err := b.attempt(handler, primary, items)
+		if err == nil || newBackoff == nil {
+			return err
+		}
+
+		// retry for as long as the backoff policy allows
+		if backoff == nil {
+			backoff = newBackoff()
+		}
+		delay, ok := backoff.Next()
+		if !ok {
+			b.logf("batch handler failed, giving up after retries: %v", err)
+			return err
+		}
+		b.logf("batch handler failed, retrying in %s: %v", delay, err)
+		if !sleepContext(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// attempt makes a single call to the handler
+func (b *Batch) attempt(handler BatchHandler, primary bool, items []interface{}) error {
+	start := time.Now()
+	err := handler(items)
+	elapsed := time.Since(start)
+	if primary {
+		b.observeLatency(elapsed)
+	}
+	b.trackLatency(elapsed)
+	return err
 }
@@ -0,0 +1,90 @@
+package work
+
+// SetAck sets a function to acknowledge records pushed with PushWithAck - once a batch has been handled successfully,
+// it's called with the tokens of that batch's records, in order (e.g. to commit a queue offset or delete a message).
+// Records pushed with Push, or with a nil token, contribute nothing; when a record replaces a buffered duplicate, the
+// tokens of both are acknowledged with the batch, and batches with no tokens aren't acknowledged at all.  With
+// SetCommitEvery, tokens are held until their group commits, then acknowledged together.  Batches that fail (or whose
+// group rolls back), are dropped or are discarded on close are never acknowledged.  ack is called with the commit lock
+// held, so acknowledgements arrive in the order batches completed.  An error from ack is returned by whatever call
+// handled the batch, as a handler error would be.
+func (b *Batch) SetAck(ack func(tokens []interface{}) error) {
+	b.mutex.Lock()
+	b.ack = ack
+	b.mutex.Unlock()
+}
+
+// PushWithAck is Push for a record with an acknowledgement token, which travels with the record through the buffer and
+// is handed to the ack function (see SetAck) once the record's batch has been handled successfully
+func (b *Batch) PushWithAck(record interface{}, token interface{}) error {
+	return b.push(record, token, true)
+}
+
+// mergedTokens holds the tokens of records that replaced each other in the buffer, which are all acknowledged together
+type mergedTokens []interface{}
+
+// trackTokensLocked starts keeping a token alongside each buffered record, if it isn't already - the caller must hold
+// the lock
+func (b *Batch) trackTokensLocked() {
+	if !b.hasTokens {
+		b.hasTokens = true
+		b.tokens = make([]interface{}, b.batchPosition)
+	}
+}
+
+// appendTokenLocked keeps the token for the record just appended to the buffer - the caller must hold the lock
+func (b *Batch) appendTokenLocked(token interface{}) {
+	if b.hasTokens {
+		b.tokens = append(b.tokens[:b.batchPosition], token)
+	}
+}
+
+// mergeTokenLocked adds the token to those of the buffered record at i, which the record it belongs to replaced - the
+// caller must hold the lock
+func (b *Batch) mergeTokenLocked(i int, token interface{}) {
+	if token == nil {
+		return
+	}
+
+	switch existing := b.tokens[i].(type) {
+	case nil:
+		b.tokens[i] = token
+	case mergedTokens:
+		b.tokens[i] = append(existing, token)
+	default:
+		b.tokens[i] = mergedTokens{existing, token}
+	}
+}
+
+// takeTokensLocked returns the tokens of the buffered records from position from up to to, or nil if no record has been
+// pushed with a token - the caller must hold the lock
+func (b *Batch) takeTokensLocked(from, to int) []interface{} {
+	if !b.hasTokens {
+		return nil
+	}
+	return b.tokens[from:to]
+}
+
+// acknowledge hands the tokens of a successfully-handled batch to the ack function, if there are any
+func (b *Batch) acknowledge(tokens []interface{}) error {
+	var flat []interface{}
+	for _, token := range tokens {
+		if merged, ok := token.(mergedTokens); ok {
+			flat = append(flat, merged...)
+		} else if token != nil {
+			flat = append(flat, token)
+		}
+	}
+	if len(flat) == 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	ack := b.ack
+	b.mutex.Unlock()
+
+	if ack == nil {
+		return nil
+	}
+	return ack(flat)
+}
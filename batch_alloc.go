@@ -0,0 +1,46 @@
+package work
+
+// SetBufferAllocator replaces how the batch allocates its buffers, for integrating pool or arena allocators - alloc is
+// called for a fresh buffer of length n, and release once the batch is done with a buffer: after the handler it was
+// handed to returns (or the batch was dropped or discarded).  The released buffer still holds its records, so clear it
+// before reuse if that matters.  Since buffers are reused, handlers must not retain their batch slice after returning
+// (which rules out NewChannelBatch).  Both are called with the batch's lock held, so they mustn't call back into the
+// batch.  By default, buffers are made as needed and left to the garbage collector.
+func (b *Batch) SetBufferAllocator(alloc func(n int) []interface{}, release func([]interface{})) {
+	b.mutex.Lock()
+	b.alloc = alloc
+	b.release = release
+	b.mutex.Unlock()
+}
+
+// allocBuffer returns a fresh buffer of length n - the caller must hold the lock
+func (b *Batch) allocBuffer(n int) []interface{} {
+	if b.alloc != nil {
+		return b.alloc(n)
+	}
+	return make([]interface{}, n, n)
+}
+
+// growLocked doubles the buffer, which only happens while paused - the caller must hold the lock
+func (b *Batch) growLocked() {
+	grown := b.allocBuffer(2 * len(b.itemsToSave))
+	copy(grown, b.itemsToSave)
+
+	// the buffer was never handed out, so it can be released now
+	b.releaseBufferLocked(b.itemsToSave)
+	b.itemsToSave = grown
+}
+
+// releaseBuffer hands the buffer that the batch is a prefix of back to the allocator, if one is configured
+func (b *Batch) releaseBuffer(batch []interface{}) {
+	b.mutex.Lock()
+	b.releaseBufferLocked(batch)
+	b.mutex.Unlock()
+}
+
+// releaseBufferLocked is releaseBuffer for when the caller holds the lock
+func (b *Batch) releaseBufferLocked(batch []interface{}) {
+	if b.release != nil && batch != nil {
+		b.release(batch[:cap(batch)])
+	}
+}
@@ -0,0 +1,91 @@
+package work
+
+import "errors"
+
+// SetBulkAtomic configures how PushSlice handles a failure part-way through a slice - when atomic, it stops at the first
+// failed push, so nothing after it is pushed; otherwise (the default) it's best-effort, pushing every record and
+// reporting all failures together.  Atomicity is only ever partial: the handler calls made before the failure have
+// already happened, along with whatever side effects they had, and can't be undone by the batch.
+func (b *Batch) SetBulkAtomic(atomic bool) {
+	b.mutex.Lock()
+	b.bulkAtomic = atomic
+	b.mutex.Unlock()
+}
+
+// PushSlice pushes each of the records in order, returning how many were pushed successfully.  By default, every record
+// is pushed and the errors are returned as a MultiError - a failing handler call fails the push that triggered it, so
+// that record is counted as not pushed, even though it's buffered, while the records lost with the failed batch were
+// pushed earlier.  Other pushes may interleave with the slice's.
+//
+// In atomic mode (see SetBulkAtomic), the count is where to resume from after a failure: every record before it was
+// accepted (handled, or still buffered), and none from it on were.  To keep that accurate, anything already buffered
+// is flushed first, and each full buffer is handed to the push handler as soon as it fills, rather than on the next
+// push, so a failed batch only ever holds records of the slice - the count is then where that batch started, as its
+// records were lost.  This relies on nothing else pushing to the batch during the call.
+func (b *Batch) PushSlice(records []interface{}) (int, error) {
+	if b.batchSize == 0 {
+		return 0, errors.New("batch not initialized")
+	}
+
+	b.mutex.Lock()
+	atomic := b.bulkAtomic
+	b.mutex.Unlock()
+
+	if atomic {
+		return b.pushSliceAtomic(records)
+	}
+
+	pushed := 0
+	var errs MultiError
+	for _, record := range records {
+		if err := b.Push(record); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pushed++
+	}
+	return pushed, errs.errorOrNil()
+}
+
+// pushSliceAtomic does the work of PushSlice in atomic mode, counting records as accepted once their batch is handled
+// or they're buffered
+func (b *Batch) pushSliceAtomic(records []interface{}) (int, error) {
+	if err := b.Flush(); err != nil && err != ErrBatchClosed {
+		return 0, err
+	}
+
+	// where the batch currently being filled started
+	batchStart := 0
+	for i, record := range records {
+		if err := b.Push(record); err != nil {
+			// a size-one batch hands each record off as it's pushed, so the failed one is lost rather than buffered
+			if b.batchSize == 1 {
+				return batchStart, err
+			}
+			return i, err
+		}
+
+		handed, err := b.handOffFull()
+		if err != nil {
+			return batchStart, err
+		}
+		if handed || b.batchSize == 1 {
+			batchStart = i + 1
+		}
+	}
+	return len(records), nil
+}
+
+// handOffFull hands the buffer to the push handler once it's full, rather than waiting for the next push, reporting
+// whether it did
+func (b *Batch) handOffFull() (bool, error) {
+	b.mutex.Lock()
+	if b.paused || b.closed || b.batchPosition < b.batchSize {
+		b.mutex.Unlock()
+		return false, nil
+	}
+
+	batch, tokens := b.takeLocked()
+	b.mutex.Unlock()
+	return true, b.callBuffer(b.pushHandler, batch, tokens)
+}
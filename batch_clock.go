@@ -0,0 +1,182 @@
+package work
+
+import (
+	"errors"
+	"time"
+)
+
+// SetFlushInterval makes the batch flush records once they have been buffered for at least d, so a slow trickle of
+// records doesn't sit in a partially-filled batch indefinitely - zero (the default) disables it.  Unless the batch uses
+// a manual clock, a background goroutine checks every d/2, and errors from flushes it triggers go to the OnError hook.
+func (b *Batch) SetFlushInterval(d time.Duration) {
+	b.mutex.Lock()
+	b.flushInterval = d
+	b.startTimer()
+	b.mutex.Unlock()
+}
+
+// SetMaxLifetime makes the batch flush and close itself once d has passed (from when this is called), forcing a clean
+// checkpoint and releasing its resources - the supervising code can use SetOnClosed to learn of it and create a fresh
+// batch.  Closing happens as if Close were called (pushes after it fail or are dropped, per the closed policy), and any
+// errors from it go to the OnError hook.  With a manual clock, the batch closes on the first Tick at or after the
+// deadline.  Zero (the default) disables it.
+func (b *Batch) SetMaxLifetime(d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.stopLifetimeTimer()
+	b.deadline = time.Time{}
+	if d <= 0 || b.closed {
+		return
+	}
+
+	b.deadline = b.now().Add(d)
+	if !b.manualClock {
+		b.lifetimeTimer = time.AfterFunc(d, func() {
+			if err := b.Close(); err != nil {
+				b.reportError(err)
+			}
+		})
+	}
+}
+
+// SetOnClosed sets a function to call once the batch has closed, whether by Close or by reaching its maximum lifetime
+func (b *Batch) SetOnClosed(fn func()) {
+	b.mutex.Lock()
+	b.onClosed = fn
+	b.mutex.Unlock()
+}
+
+// stopLifetimeTimer stops the timer that closes the batch at its maximum lifetime, if one is running - the caller must
+// hold the lock
+func (b *Batch) stopLifetimeTimer() {
+	if b.lifetimeTimer != nil {
+		b.lifetimeTimer.Stop()
+		b.lifetimeTimer = nil
+	}
+}
+
+// SetOnError sets a function to receive errors that have no caller to return to, such as those from flushes triggered
+// in the background
+func (b *Batch) SetOnError(fn func(error)) {
+	b.mutex.Lock()
+	b.onError = fn
+	b.mutex.Unlock()
+}
+
+// SetManualClock stops the batch from spawning any background goroutine for time-based behavior - instead, time only
+// passes when Tick is called, which runs anything that has come due synchronously.  The clock starts at the wall-clock
+// time SetManualClock is called.  This is mostly useful for deterministic tests.
+func (b *Batch) SetManualClock() {
+	b.mutex.Lock()
+	b.manualClock = true
+	b.manualNow = time.Now()
+	b.stopTimer()
+	b.mutex.Unlock()
+}
+
+// Tick advances the manual clock to now and performs any time-based work that has come due, returning the first error
+func (b *Batch) Tick(now time.Time) error {
+	b.mutex.Lock()
+	if !b.manualClock {
+		b.mutex.Unlock()
+		return errors.New("tick called on batch without a manual clock")
+	}
+	b.manualNow = now
+	b.mutex.Unlock()
+
+	return b.tick(now)
+}
+
+// tick performs any time-based work that has come due as of now
+func (b *Batch) tick(now time.Time) error {
+	if err := b.releaseHeld(now); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	expired := !b.closed && !b.deadline.IsZero() && !now.Before(b.deadline)
+	b.mutex.Unlock()
+	if expired {
+		b.logf("batch reached its max lifetime, closing")
+		return b.Close()
+	}
+
+	b.mutex.Lock()
+	if b.closed || b.paused || b.batchPosition == 0 {
+		b.mutex.Unlock()
+		return nil
+	}
+
+	if b.flushInterval <= 0 || now.Sub(b.enqueued[0]) < b.flushInterval {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.logf("batch flushing %d records: flush interval elapsed", b.batchPosition)
+	return b.flushLocked()
+}
+
+// now returns the batch's current time - the caller must hold the lock
+func (b *Batch) now() time.Time {
+	if b.manualClock {
+		return b.manualNow
+	}
+	return time.Now()
+}
+
+// startTimer (re)starts the background goroutine driving time-based behavior, if any is needed - the caller must hold
+// the lock
+func (b *Batch) startTimer() {
+	b.stopTimer()
+
+	period := b.timerPeriod()
+	if b.manualClock || b.closed || period <= 0 {
+		return
+	}
+
+	stop := make(chan bool)
+	b.timerStop = stop
+	ticker := time.NewTicker(period)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := b.tick(now); err != nil {
+					b.reportError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// timerPeriod returns how often the background goroutine needs to check for due work, or zero if it isn't needed - the
+// caller must hold the lock
+func (b *Batch) timerPeriod() time.Duration {
+	if b.flushInterval > 0 {
+		return b.flushInterval / 2
+	}
+	return 0
+}
+
+// stopTimer stops the background goroutine, if one is running - the caller must hold the lock
+func (b *Batch) stopTimer() {
+	if b.timerStop != nil {
+		close(b.timerStop)
+		b.timerStop = nil
+	}
+}
+
+// reportError hands an error with no caller to return to over to the OnError hook, if one is set
+func (b *Batch) reportError(err error) {
+	b.mutex.Lock()
+	onError := b.onError
+	b.mutex.Unlock()
+
+	if onError != nil {
+		onError(err)
+	}
+}
@@ -0,0 +1,104 @@
+package work
+
+// SetCommitEvery groups handler calls into downstream transactions - after every n successful push/flush handler calls
+// (and on Close, for a partial group), commit is called to finalize the transaction the handlers have been writing
+// within.  When a handler fails, the optional rollback is called instead, abandoning the group, and counting starts
+// afresh.  Zero disables grouping.  See SetTxBeginner for having the batch manage the group's transaction itself.  While
+// grouping, ack tokens (see PushWithAck) are held until their group commits, and never acknowledged if it rolls back.
+// Changing the grouping abandons the group in progress, along with its tokens.
+func (b *Batch) SetCommitEvery(n int, commit func() error, rollback ...func() error) {
+	b.commitMutex.Lock()
+	b.commitEvery = n
+	b.commit = commit
+	b.rollback = nil
+	if len(rollback) > 0 {
+		b.rollback = rollback[0]
+	}
+	b.uncommitted = 0
+	b.groupTokens = nil
+	b.commitMutex.Unlock()
+}
+
+// completeGroup accounts for a finished handler call, committing the group once it's complete, or rolling it back when
+// the handler failed - the call's tokens are acknowledged once it's committed (right away, when not grouping)
+func (b *Batch) completeGroup(err error, tokens []interface{}) error {
+	b.commitMutex.Lock()
+	defer b.commitMutex.Unlock()
+
+	if b.commitEvery <= 0 {
+		if err != nil {
+			return err
+		}
+		return b.acknowledge(tokens)
+	}
+
+	if err != nil {
+		b.uncommitted = 0
+		if rollbackErr := b.rollbackLocked(); rollbackErr != nil {
+			return MultiError{err, rollbackErr}
+		}
+		return err
+	}
+
+	b.groupTokens = append(b.groupTokens, tokens...)
+	b.uncommitted++
+	if b.uncommitted < b.commitEvery {
+		return nil
+	}
+	b.uncommitted = 0
+	return b.commitLocked()
+}
+
+// commitPending commits a partially-complete group, if there is one
+func (b *Batch) commitPending() error {
+	b.commitMutex.Lock()
+	defer b.commitMutex.Unlock()
+
+	if b.commitEvery <= 0 || b.uncommitted == 0 {
+		return nil
+	}
+	b.uncommitted = 0
+	return b.commitLocked()
+}
+
+// commitLocked finalizes the group's transaction, then calls the commit callback, and acknowledges the group's tokens
+// once both have succeeded - the caller must hold the commit lock
+func (b *Batch) commitLocked() error {
+	tokens := b.groupTokens
+	b.groupTokens = nil
+
+	if tx := b.groupTx; tx != nil {
+		b.groupTx = nil
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if b.commit != nil {
+		if err := b.commit(); err != nil {
+			return err
+		}
+	}
+	return b.acknowledge(tokens)
+}
+
+// rollbackLocked abandons the group's transaction, and its tokens, then calls the rollback callback - the caller must
+// hold the commit lock
+func (b *Batch) rollbackLocked() error {
+	b.groupTokens = nil
+
+	var errs MultiError
+	if tx := b.groupTx; tx != nil {
+		b.groupTx = nil
+		if err := tx.Rollback(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if b.rollback != nil {
+		if err := b.rollback(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
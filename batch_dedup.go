@@ -0,0 +1,61 @@
+package work
+
+// SetDedupKey deduplicates records within the buffer by a string key - when a pushed record has the same key as one
+// already buffered, it replaces that record in place (so the latest version wins, at the original position).  This is
+// the efficient way to deduplicate, costing a map lookup per push.
+func (b *Batch) SetDedupKey(keyFn func(interface{}) string) {
+	b.mutex.Lock()
+	b.dedupKey = keyFn
+	b.dedupEqual = nil
+	b.reindexLocked()
+	b.mutex.Unlock()
+}
+
+// SetDedupEqual deduplicates records within the buffer by structural equality, for when a cheap string key isn't
+// available - a pushed record equal to a buffered one replaces it in place.  Each push compares against every buffered
+// record, so this costs O(n) per push (O(n²) per batch) and is only suitable for small batch sizes; prefer SetDedupKey
+// (e.g. with a hash of the record as the key) for large batches.
+func (b *Batch) SetDedupEqual(equal func(a, b interface{}) bool) {
+	b.mutex.Lock()
+	b.dedupEqual = equal
+	b.dedupKey = nil
+	b.reindexLocked()
+	b.mutex.Unlock()
+}
+
+// dedupLocked replaces a buffered duplicate of the record, if there is one, returning the record's dedup key (when
+// deduplicating by key) and the position of the record it replaced (or -1) - the caller must hold the lock
+func (b *Batch) dedupLocked(record interface{}) (string, int) {
+	if b.dedupKey != nil {
+		key := b.dedupKey(record)
+		if i, ok := b.dedupIndex[key]; ok {
+			b.itemsToSave[i] = record
+			return key, i
+		}
+		return key, -1
+	}
+
+	if b.dedupEqual != nil {
+		for i := 0; i < b.batchPosition; i++ {
+			if b.dedupEqual(b.itemsToSave[i], record) {
+				b.itemsToSave[i] = record
+				return "", i
+			}
+		}
+	}
+
+	return "", -1
+}
+
+// reindexLocked rebuilds the dedup key index for the buffer's current contents - the caller must hold the lock
+func (b *Batch) reindexLocked() {
+	if b.dedupKey == nil {
+		b.dedupIndex = nil
+		return
+	}
+
+	b.dedupIndex = make(map[string]int, b.batchPosition)
+	for i := 0; i < b.batchPosition; i++ {
+		b.dedupIndex[b.dedupKey(b.itemsToSave[i])] = i
+	}
+}
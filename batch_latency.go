@@ -0,0 +1,70 @@
+package work
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyReservoirSize bounds the number of handler call durations kept for estimating percentiles
+const latencyReservoirSize = 1024
+
+// SetLatencyTracking records how long each handler call takes, for LatencyPercentiles.  Memory is bounded - a uniform
+// sample (reservoir) of up to 1024 durations is kept - and when disabled (the default), the cost is a single atomic
+// load per handler call.  Disabling discards the samples.
+func (b *Batch) SetLatencyTracking(enabled bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if enabled {
+		atomic.StoreInt32(&b.latencyTracking, 1)
+		return
+	}
+	atomic.StoreInt32(&b.latencyTracking, 0)
+	b.latencies = nil
+	b.latencyCount = 0
+}
+
+// LatencyPercentiles returns the p50, p95 and p99 handler call durations (keyed 0.5, 0.95 and 0.99), estimated from the
+// sampled durations - it's empty until latency tracking has seen a handler call
+func (b *Batch) LatencyPercentiles() map[float64]time.Duration {
+	b.mutex.Lock()
+	samples := append([]time.Duration(nil), b.latencies...)
+	b.mutex.Unlock()
+
+	percentiles := make(map[float64]time.Duration)
+	if len(samples) == 0 {
+		return percentiles
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	for _, p := range []float64{0.5, 0.95, 0.99} {
+		i := int(p*float64(len(samples))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		percentiles[p] = samples[i]
+	}
+	return percentiles
+}
+
+// trackLatency adds a handler call duration to the sample, if latency tracking is enabled
+func (b *Batch) trackLatency(d time.Duration) {
+	if atomic.LoadInt32(&b.latencyTracking) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// fill the reservoir, then replace samples with decreasing probability, so every call is equally likely to be kept
+	b.latencyCount++
+	if len(b.latencies) < latencyReservoirSize {
+		b.latencies = append(b.latencies, d)
+	} else if i := rand.Int63n(b.latencyCount); i < latencyReservoirSize {
+		b.latencies[i] = d
+	}
+}
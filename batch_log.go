@@ -0,0 +1,26 @@
+package work
+
+// Logger receives the batch's diagnostic logging - it's satisfied by *log.Logger, and is easily adapted from other
+// logging libraries
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// loggerHolder lets a Logger be stored in an atomic.Value, which needs a consistent concrete type
+type loggerHolder struct {
+	logger Logger
+}
+
+// SetLogger makes the batch log significant internal events - flushes triggered by time or memory pressure, retries,
+// diversions to and from the slow-flush handler, pausing, delays and drops by the pre-flush hook, and closing.  Nothing
+// is logged per record.  Without a logger (the default), the batch is silent.
+func (b *Batch) SetLogger(logger Logger) {
+	b.logger.Store(loggerHolder{logger: logger})
+}
+
+// logf logs through the configured logger, if there is one - it's safe to call with or without the lock held
+func (b *Batch) logf(format string, args ...interface{}) {
+	if holder, ok := b.logger.Load().(loggerHolder); ok && holder.logger != nil {
+		holder.logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,181 @@
+package work
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// defaultMemoryCheckInterval is how often a memory monitor checks memory usage - reading the runtime's memory stats
+// briefly stops the world, so it shouldn't happen too often
+const defaultMemoryCheckInterval = time.Second
+
+// MemoryMonitor flushes a group of batches early when the process's memory usage reaches a limit, which helps avoid
+// OOMs when many batches accumulate during a downstream slowdown.  Memory usage is a process-wide measure, so one
+// monitor is shared by every batch that should respond: it checks usage once per interval (every second, by default -
+// see SetCheckInterval) with the probe set by SetProbe, which defaults to the runtime's live heap size, and flushes all
+// the joined batches when it's over the limit.  This is best-effort, not a hard guarantee: memory can grow past the
+// limit between checks, and flushing only helps if the handlers release the records.
+type MemoryMonitor struct {
+	limit    uint64
+	interval time.Duration
+	probe    func() uint64
+	manual   bool
+
+	batches map[*Batch]bool
+	stop    chan struct{}
+	mutex   sync.Mutex
+}
+
+// NewMemoryMonitor creates a monitor that flushes its batches when memory usage reaches limitBytes
+func NewMemoryMonitor(limitBytes uint64) *MemoryMonitor {
+	return &MemoryMonitor{
+		limit:    limitBytes,
+		interval: defaultMemoryCheckInterval,
+		probe:    heapAlloc,
+		batches:  make(map[*Batch]bool),
+	}
+}
+
+// SetCheckInterval sets how often the monitor checks memory usage - zero or less restores the default
+func (m *MemoryMonitor) SetCheckInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultMemoryCheckInterval
+	}
+
+	m.mutex.Lock()
+	m.interval = d
+	m.mutex.Unlock()
+}
+
+// SetProbe replaces the function used to measure memory usage
+func (m *MemoryMonitor) SetProbe(probe func() uint64) {
+	if probe == nil {
+		probe = heapAlloc
+	}
+
+	m.mutex.Lock()
+	m.probe = probe
+	m.mutex.Unlock()
+}
+
+// SetManualClock stops the monitor checking memory usage in the background - memory usage is then only checked when
+// Check is called, which makes the monitor deterministic to test
+func (m *MemoryMonitor) SetManualClock() {
+	m.mutex.Lock()
+	m.manual = true
+	m.stopLocked()
+	m.mutex.Unlock()
+}
+
+// JoinMemoryMonitor adds the batch to the monitor, so it is flushed whenever memory usage reaches the monitor's limit.
+// Unless the monitor uses a manual clock, it checks in the background while any batch is joined, and errors from the
+// flushes it triggers go to each batch's OnError hook.
+func (b *Batch) JoinMemoryMonitor(monitor *MemoryMonitor) {
+	monitor.mutex.Lock()
+	monitor.batches[b] = true
+	if !monitor.manual && monitor.stop == nil {
+		monitor.stop = make(chan struct{})
+		go monitor.run(monitor.stop)
+	}
+	monitor.mutex.Unlock()
+}
+
+// LeaveMemoryMonitor removes the batch from the monitor
+func (b *Batch) LeaveMemoryMonitor(monitor *MemoryMonitor) {
+	monitor.mutex.Lock()
+	monitor.removeLocked(b)
+	monitor.mutex.Unlock()
+}
+
+// Check measures memory usage once and, if it has reached the limit, flushes every joined batch concurrently,
+// returning once all of them have completed.  Any errors are aggregated into a MultiError.  Batches that have been
+// closed are skipped, and leave the monitor.
+func (m *MemoryMonitor) Check() error {
+	return m.check(false)
+}
+
+// run checks memory usage every interval until stop is closed
+func (m *MemoryMonitor) run(stop chan struct{}) {
+	for {
+		m.mutex.Lock()
+		timer := time.NewTimer(m.interval)
+		m.mutex.Unlock()
+
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			_ = m.check(true)
+		}
+	}
+}
+
+// check runs one check - with report set, flush errors go to each batch's OnError hook rather than being returned
+func (m *MemoryMonitor) check(report bool) error {
+	m.mutex.Lock()
+	probe, limit := m.probe, m.limit
+	m.mutex.Unlock()
+
+	usage := probe()
+	if usage < limit {
+		return nil
+	}
+
+	m.mutex.Lock()
+	batches := make([]*Batch, 0, len(m.batches))
+	for b := range m.batches {
+		batches = append(batches, b)
+	}
+	m.mutex.Unlock()
+
+	var errs MultiError
+	var errsMutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(batches))
+
+	for _, b := range batches {
+		go func(b *Batch) {
+			defer wg.Done()
+			b.logf("batch flushing: memory usage of %d bytes reached the monitor's limit of %d", usage, limit)
+
+			err := b.Flush()
+			switch {
+			case err == ErrBatchClosed:
+				b.LeaveMemoryMonitor(m)
+			case err != nil && report:
+				b.reportError(err)
+			case err != nil:
+				errsMutex.Lock()
+				errs = append(errs, err)
+				errsMutex.Unlock()
+			}
+		}(b)
+	}
+
+	wg.Wait()
+	return errs.errorOrNil()
+}
+
+// removeLocked removes the batch, stopping background checks once no batch is left - the caller must hold the lock
+func (m *MemoryMonitor) removeLocked(b *Batch) {
+	delete(m.batches, b)
+	if len(m.batches) == 0 {
+		m.stopLocked()
+	}
+}
+
+// stopLocked stops background checks, if they're running - the caller must hold the lock
+func (m *MemoryMonitor) stopLocked() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+func heapAlloc() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
@@ -0,0 +1,25 @@
+package work
+
+import "fmt"
+
+// SetAssertOrder installs a debugging aid that verifies each pushed record is correctly ordered relative to the one
+// pushed before it (e.g. increasing timestamps) - when inOrder returns false, Push panics.  It's off by default, and
+// costs nothing when unset.
+func (b *Batch) SetAssertOrder(inOrder func(prev, next interface{}) bool) {
+	b.mutex.Lock()
+	b.assertOrder = inOrder
+	b.hasLast = false
+	b.last = nil
+	b.mutex.Unlock()
+}
+
+// checkOrder panics if the record is out of order relative to the last pushed record - the caller must hold the lock
+func (b *Batch) checkOrder(record interface{}) {
+	if b.hasLast && !b.assertOrder(b.last, record) {
+		prev := b.last
+		b.mutex.Unlock()
+		panic(fmt.Sprintf("batch records out of order: %v pushed after %v", record, prev))
+	}
+	b.last = record
+	b.hasLast = true
+}
@@ -0,0 +1,115 @@
+package work
+
+import "errors"
+
+// PauseOverflowPolicy determines what Push does when a paused batch has buffered as many records as it's allowed
+type PauseOverflowPolicy int
+
+const (
+	// BlockOnPauseOverflow makes Push wait until the batch is resumed (the default)
+	BlockOnPauseOverflow PauseOverflowPolicy = iota
+
+	// ErrorOnPauseOverflow makes Push return ErrPauseOverflow
+	ErrorOnPauseOverflow
+)
+
+// ErrPauseOverflow is returned when pushing to a paused batch that has reached its overflow limit
+var ErrPauseOverflow = errors.New("paused batch overflow limit reached")
+
+// Pause stops the batch from calling its handlers - e.g. to quiesce writes during a downstream maintenance window.  While
+// paused, pushes are buffered (even beyond the batch size) up to the overflow limit, and Flush and interval flushes do
+// nothing.  Close still delivers everything buffered.
+func (b *Batch) Pause() {
+	b.mutex.Lock()
+	if !b.paused {
+		b.logf("batch paused")
+	}
+	b.paused = true
+	b.mutex.Unlock()
+}
+
+// Resume lets the batch call its handlers again, handing any full batches that accumulated while paused to the push
+// handler.  Errors from those calls are aggregated into a MultiError.
+func (b *Batch) Resume() error {
+	b.mutex.Lock()
+	if !b.paused {
+		b.mutex.Unlock()
+		return nil
+	}
+
+	b.paused = false
+	b.pauseCond.Broadcast()
+	b.logf("batch resumed with %d buffered records", b.batchPosition)
+	overflow, tokens := b.takeOverflowLocked()
+	b.mutex.Unlock()
+
+	return b.callEach(b.pushHandler, overflow, tokens)
+}
+
+// SetPauseOverflow limits how many records a paused batch buffers, and what Push does once the limit is reached - zero
+// (the default) means no limit
+func (b *Batch) SetPauseOverflow(limit int, policy PauseOverflowPolicy) {
+	b.mutex.Lock()
+	b.pauseLimit = limit
+	b.pausePolicy = policy
+	b.pauseCond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// waitForPauseOverflow blocks (or errors, per the policy) while a paused batch is at its overflow limit - the caller
+// must hold the lock
+func (b *Batch) waitForPauseOverflow() error {
+	for b.paused && !b.closed && b.pauseLimit > 0 && b.batchPosition >= b.pauseLimit {
+		if b.pausePolicy == ErrorOnPauseOverflow {
+			return ErrPauseOverflow
+		}
+		b.pauseCond.Wait()
+	}
+	return nil
+}
+
+// takeOverflowLocked removes the full batches that accumulated beyond the batch size while paused, leaving the
+// remainder buffered - along with the batches, it returns their ack tokens.  Each batch is copied into a buffer of its
+// own, which it owns, so a batch the pre-flush hook holds on to can't be overwritten once the shared buffer is reused.
+// The caller must hold the lock.
+func (b *Batch) takeOverflowLocked() ([][]interface{}, [][]interface{}) {
+	if b.batchPosition <= b.batchSize && b.batchSize > 1 {
+		return nil, nil
+	}
+
+	items := b.itemsToSave[:b.batchPosition]
+	var batches, tokens [][]interface{}
+	for len(items) > b.batchSize || (b.batchSize == 1 && len(items) > 0) {
+		start := b.batchPosition - len(items)
+		batch := b.allocBuffer(b.batchSize)
+		copy(batch, items[:b.batchSize])
+		batches = append(batches, batch)
+		tokens = append(tokens, b.takeTokensLocked(start, start+b.batchSize))
+		items = items[b.batchSize:]
+	}
+	remaining := b.takeTokensLocked(b.batchPosition-len(items), b.batchPosition)
+
+	// keep the remainder in a fresh buffer too, so nothing references the old one, which can be released
+	buffer := b.itemsToSave
+	b.enqueued = append(b.enqueued[:0], b.enqueued[b.batchPosition-len(items):b.batchPosition]...)
+	b.itemsToSave = b.allocBuffer(b.batchSize)
+	b.batchPosition = copy(b.itemsToSave, items)
+	if b.hasTokens {
+		b.tokens = append([]interface{}(nil), remaining...)
+	}
+	b.releaseBufferLocked(buffer)
+	b.reindexLocked()
+	return batches, tokens
+}
+
+// callEach hands each batch, which owns its buffer, to the handler in order, acknowledging the corresponding tokens,
+// and aggregating any errors into a MultiError
+func (b *Batch) callEach(handler BatchHandler, batches [][]interface{}, tokens [][]interface{}) error {
+	var errs MultiError
+	for i, batch := range batches {
+		if err := b.callOwned(handler, batch, true, tokens[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
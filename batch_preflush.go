@@ -0,0 +1,169 @@
+package work
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FlushAction is a pre-flush hook's decision about a batch - one of Proceed, Drop or Delay(d)
+type FlushAction struct {
+	drop  bool
+	delay time.Duration
+}
+
+var (
+	// Proceed hands the batch to its handler as usual
+	Proceed = FlushAction{}
+
+	// Drop discards the batch, counting its records as dropped (see GetDropped)
+	Drop = FlushAction{drop: true}
+)
+
+// Delay holds the batch for d, after which the pre-flush hook is consulted again
+func Delay(d time.Duration) FlushAction {
+	return FlushAction{delay: d}
+}
+
+// heldBatch is a batch delayed by the pre-flush hook
+type heldBatch struct {
+	handler BatchHandler
+	items   []interface{}
+	owned   bool
+	tokens  []interface{}
+	due     time.Time
+}
+
+// SetPreFlush sets a hook that's consulted before each batch is handed to the push or flush handler, for checking
+// runtime conditions (is downstream accepting writes, is there quota left) - it can let the batch through, drop it, or
+// delay it.  A delayed batch is held until it's due (checked by a timer, or on Tick with a manual clock), then offered
+// to the hook again, so batches may reach the handler out of order.  The hook runs outside the lock, but on the
+// goroutine delivering the batch, so a slow hook slows the push that filled the batch.  Close delivers held batches
+// without consulting the hook (or, with SetDiscardOnClose, discards them), and once the batch is closed, nothing more
+// is held - a hook's Delay is treated as Proceed.
+func (b *Batch) SetPreFlush(hook func(batch []interface{}) FlushAction) {
+	b.mutex.Lock()
+	b.preFlushHook = hook
+	b.mutex.Unlock()
+}
+
+// preFlush consults the pre-flush hook about the batch, returning whether to deliver it now - a delayed batch keeps its
+// buffer (when it owns one) until it's delivered
+func (b *Batch) preFlush(handler BatchHandler, items []interface{}, owned bool, tokens []interface{}) bool {
+	b.mutex.Lock()
+	hook := b.preFlushHook
+	b.mutex.Unlock()
+
+	if hook == nil {
+		return true
+	}
+
+	action := hook(items)
+	if action.drop {
+		b.logf("batch pre-flush hook dropped %d records", len(items))
+		atomic.AddInt64(&b.dropped, int64(len(items)))
+		if owned {
+			b.releaseBuffer(items)
+		}
+		return false
+	}
+	if action.delay <= 0 {
+		return true
+	}
+	b.logf("batch pre-flush hook delayed %d records by %s", len(items), action.delay)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Close has already taken the held batches, so this one goes through now
+	if b.closed {
+		return true
+	}
+
+	b.held = append(b.held, heldBatch{handler: handler, items: items, owned: owned, tokens: tokens, due: b.now().Add(action.delay)})
+	if !b.manualClock {
+		var timer *time.Timer
+		timer = time.AfterFunc(action.delay, func() {
+			b.mutex.Lock()
+			delete(b.heldTimers, timer)
+			b.mutex.Unlock()
+
+			if err := b.releaseHeld(time.Now()); err != nil {
+				b.reportError(err)
+			}
+		})
+		if b.heldTimers == nil {
+			b.heldTimers = make(map[*time.Timer]bool)
+		}
+		b.heldTimers[timer] = true
+	}
+	return false
+}
+
+// stopHeldTimersLocked stops the timers waiting to release held batches - the caller must hold the lock
+func (b *Batch) stopHeldTimersLocked() {
+	for timer := range b.heldTimers {
+		timer.Stop()
+	}
+	b.heldTimers = nil
+}
+
+// discardHeldLocked throws away the held batches, releasing their buffers - the caller must hold the lock
+func (b *Batch) discardHeldLocked() {
+	b.stopHeldTimersLocked()
+	for _, held := range b.held {
+		if held.owned {
+			b.releaseBufferLocked(held.items)
+		}
+	}
+	b.held = nil
+}
+
+// releaseHeld offers the held batches that are due as of now to the hook again - once the batch is closed, there's
+// nothing left to release, as Close has delivered (or discarded) them
+func (b *Batch) releaseHeld(now time.Time) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+
+	var due []heldBatch
+	kept := b.held[:0]
+	for _, held := range b.held {
+		if now.Before(held.due) {
+			kept = append(kept, held)
+		} else {
+			due = append(due, held)
+		}
+	}
+	b.held = kept
+	b.mutex.Unlock()
+
+	var errs MultiError
+	for _, held := range due {
+		if err := b.callOwned(held.handler, held.items, held.owned, held.tokens); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// deliverHeld hands every held batch to its handler, due or not, without consulting the hook
+func (b *Batch) deliverHeld() error {
+	b.mutex.Lock()
+	held := b.held
+	b.held = nil
+	b.mutex.Unlock()
+
+	var errs MultiError
+	for _, h := range held {
+		err := b.deliver(h.handler, h.items, h.tokens)
+		if h.owned {
+			b.releaseBuffer(h.items)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
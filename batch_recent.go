@@ -0,0 +1,46 @@
+package work
+
+// SetRetainRecent makes the batch keep a copy of the last n batches handed to its handlers, retrievable with
+// RecentBatches - zero (the default) disables retention.  Memory use is bounded by n times the batch size.
+func (b *Batch) SetRetainRecent(n int) {
+	b.mutex.Lock()
+	b.retainRecent = n
+	b.recent = nil
+	b.recentNext = 0
+	b.mutex.Unlock()
+}
+
+// RecentBatches returns copies of the most recently handled batches, oldest first
+func (b *Batch) RecentBatches() [][]interface{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	results := make([][]interface{}, 0, len(b.recent))
+	for i := 0; i < len(b.recent); i++ {
+		entry := b.recent[(b.recentNext+i)%len(b.recent)]
+		results = append(results, append([]interface{}(nil), entry...))
+	}
+	return results
+}
+
+// retain stores a copy of the batch in the ring buffer, if retention is enabled
+func (b *Batch) retain(items []interface{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.retainRecent <= 0 {
+		return
+	}
+
+	// copy, so the stored batch doesn't alias a buffer that may be reused
+	entry := append([]interface{}(nil), items...)
+
+	// fill the ring before we start overwriting the oldest entry
+	if len(b.recent) < b.retainRecent {
+		b.recent = append(b.recent, entry)
+		return
+	}
+
+	b.recent[b.recentNext] = entry
+	b.recentNext = (b.recentNext + 1) % b.retainRecent
+}
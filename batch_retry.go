@@ -0,0 +1,86 @@
+package work
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff is a retry policy for failed handler calls - Next returns how long to wait before the next attempt, or false
+// to give up.  It's small enough to adapt any backoff library to.
+type Backoff interface {
+	Next() (time.Duration, bool)
+}
+
+// SetBackoff makes the batch retry failed handler calls, waiting between attempts as the policy dictates.  newBackoff is
+// called for a fresh policy each time a batch fails, so policies can be stateful.  When the policy gives up, the last
+// handler error is returned.  Waits use the wall clock, even with a manual clock, and can be interrupted with
+// SetContext.
+func (b *Batch) SetBackoff(newBackoff func() Backoff) {
+	b.mutex.Lock()
+	b.newBackoff = newBackoff
+	b.mutex.Unlock()
+}
+
+// SetContext sets a context that, once done, cancels any backoff wait in progress - the pending retry is abandoned and
+// the handler error returned
+func (b *Batch) SetContext(ctx context.Context) {
+	b.mutex.Lock()
+	b.ctx = ctx
+	b.mutex.Unlock()
+}
+
+// defaultInitialBackoff is ExponentialBackoff's first wait when no Initial is set
+const defaultInitialBackoff = 100 * time.Millisecond
+
+// ExponentialBackoff is a simple Backoff that doubles the wait after each attempt, up to Max, giving up after
+// MaxRetries retries (zero means retry forever).  A zero Initial waits 100ms (or Max, if that's less) at first, so a handler that keeps failing
+// is never retried in a busy loop.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	MaxRetries int
+	retries    int
+	next       time.Duration
+}
+
+func (e *ExponentialBackoff) Next() (time.Duration, bool) {
+	if e.MaxRetries > 0 && e.retries >= e.MaxRetries {
+		return 0, false
+	}
+	e.retries++
+
+	if e.next <= 0 {
+		e.next = e.Initial
+		if e.next <= 0 {
+			e.next = defaultInitialBackoff
+			if e.Max > 0 && e.next > e.Max {
+				e.next = e.Max
+			}
+		}
+	}
+	delay := e.next
+
+	e.next *= 2
+	if e.Max > 0 && e.next > e.Max {
+		e.next = e.Max
+	}
+	return delay, true
+}
+
+// sleepContext waits for d, returning false if the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+package work
+
+import (
+	"math/rand"
+	"time"
+)
+
+// slowProbeInterval is how often a batch is sent to the primary handler while batches are being diverted, so the batch
+// notices when the primary handler recovers
+const slowProbeInterval = 10
+
+// SetSlowFlushThreshold diverts batches to slowHandler (e.g. a disk spill) when the primary push/flush handler is slow,
+// so occasional slow calls don't hold up the main path.  By default the trigger is feedback-based: a moving average of
+// the primary handler's latency is kept, and while it exceeds d batches go to slowHandler, with every 10th batch still
+// sent to the primary handler to probe for recovery.  Use SetSlowFlushSampling for a random-sampling trigger instead.
+func (b *Batch) SetSlowFlushThreshold(d time.Duration, slowHandler BatchHandler) {
+	b.mutex.Lock()
+	b.slowThreshold = d
+	b.slowHandler = slowHandler
+	b.slowLatency = 0
+	b.slowDiverted = 0
+	b.mutex.Unlock()
+}
+
+// SetSlowFlushSampling switches the slow-flush trigger to random sampling: each batch is diverted to the slow handler
+// with the given probability (0-1), regardless of observed latency.  A rate of zero restores the feedback trigger.
+func (b *Batch) SetSlowFlushSampling(rate float64) {
+	b.mutex.Lock()
+	b.slowSampleRate = rate
+	b.mutex.Unlock()
+}
+
+// route picks the handler a batch should go to, also reporting whether it's the primary handler
+func (b *Batch) route(handler BatchHandler) (BatchHandler, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.slowHandler == nil {
+		return handler, true
+	}
+
+	if b.slowSampleRate > 0 {
+		if rand.Float64() < b.slowSampleRate {
+			return b.slowHandler, false
+		}
+		return handler, true
+	}
+
+	if b.slowLatency > b.slowThreshold {
+		b.slowDiverted++
+		if b.slowDiverted%slowProbeInterval != 0 {
+			return b.slowHandler, false
+		}
+	}
+	return handler, true
+}
+
+// observeLatency folds a primary handler call duration into the moving average
+func (b *Batch) observeLatency(d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.slowHandler == nil {
+		return
+	}
+
+	wasSlow := b.slowLatency > b.slowThreshold
+	if b.slowLatency == 0 {
+		b.slowLatency = d
+	} else {
+		b.slowLatency = (b.slowLatency*7 + d*3) / 10
+	}
+
+	if b.slowLatency <= b.slowThreshold {
+		b.slowDiverted = 0
+	}
+
+	// only sampling-free diversion switches on latency
+	if isSlow := b.slowLatency > b.slowThreshold; isSlow != wasSlow && b.slowSampleRate <= 0 {
+		if isSlow {
+			b.logf("batch primary handler latency %s exceeds %s, diverting to the slow-flush handler", b.slowLatency, b.slowThreshold)
+		} else {
+			b.logf("batch primary handler latency %s recovered, resuming the primary handler", b.slowLatency)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package work
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewBatch(t *testing.T) {
@@ -114,3 +120,1269 @@ func TestBatch_Push(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestBatch_Close(t *testing.T) {
+	var received []interface{}
+	b := NewBatch(10, func(i []interface{}) error {
+		received = append(received, i...)
+		return nil
+	})
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// close should flush the remaining record
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatal("close did not flush remaining records")
+	}
+
+	if err := b.Push(2); err != ErrBatchClosed {
+		t.Fatal("push after close did not return ErrBatchClosed")
+	}
+
+	b.SetClosedPolicy(DropOnClosed)
+	if err := b.Push(3); err != nil {
+		t.Fatal(err)
+	}
+	if b.GetDropped() != 1 {
+		t.Fatal("dropped count was not 1")
+	}
+}
+
+func TestBatch_RecentBatches(t *testing.T) {
+	b := NewBatch(2, func(i []interface{}) error {
+		return nil
+	})
+	b.SetRetainRecent(2)
+
+	for i := 1; i <= 7; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	recent := b.RecentBatches()
+	if len(recent) != 2 {
+		t.Fatal("expected 2 recent batches, got " + strconv.Itoa(len(recent)))
+	}
+	if recent[0][0] != 5 || recent[1][0] != 7 {
+		t.Fatal("recent batches were not the last two, in order")
+	}
+}
+
+func TestNewChannelBatch(t *testing.T) {
+	ch := make(chan []interface{}, 2)
+	b := NewChannelBatch(2, ch)
+
+	for i := 1; i <= 3; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+
+	count := 0
+	for batch := range ch {
+		count += len(batch)
+	}
+	if count != 3 {
+		t.Fatal("expected 3 records through the channel, got " + strconv.Itoa(count))
+	}
+}
+
+func TestNewCollectorBatch(t *testing.T) {
+	b, collected := NewCollectorBatch(2)
+	for i := 0; i < 3; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(collected()) != 2 {
+		t.Fatal("expected only the handled records before a flush, got", collected())
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	records := collected()
+	if len(records) != 3 || records[0] != 0 || records[2] != 2 {
+		t.Fatal("expected every record after a flush, got", records)
+	}
+}
+
+func TestBatch_SetManualClock(t *testing.T) {
+	flushCount := 0
+	b := NewBatch(10, func(i []interface{}) error {
+		flushCount++
+		return nil
+	})
+	b.SetManualClock()
+	b.SetFlushInterval(time.Second)
+	start := time.Now()
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// not due yet
+	if err := b.Tick(start.Add(500 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if flushCount != 0 {
+		t.Fatal("flushed before the interval elapsed")
+	}
+
+	if err := b.Tick(start.Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if flushCount != 1 {
+		t.Fatal("did not flush once the interval elapsed")
+	}
+}
+
+func TestBatch_FlushOlderThan(t *testing.T) {
+	var flushed [][]interface{}
+	b := NewBatch(10, func(i []interface{}) error {
+		flushed = append(flushed, i)
+		return nil
+	})
+	b.SetManualClock()
+	start := time.Now()
+
+	if err := b.Tick(start); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []int{1, 2} {
+		if err := b.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Tick(start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []int{3, 4} {
+		if err := b.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := b.FlushOlderThan(start.Add(30 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(flushed) != 1 || flushed[0][0] != 1 || flushed[0][1] != 2 {
+		t.Fatal("expected only the older records to be flushed, got", flushed)
+	}
+	if b.GetPosition() != 2 {
+		t.Fatal("expected the newer records to stay buffered")
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 2 || len(flushed[1]) != 2 || flushed[1][0] != 3 || flushed[1][1] != 4 {
+		t.Fatal("expected the remaining records in their original order, got", flushed)
+	}
+}
+
+func TestBatch_SetCommitEvery(t *testing.T) {
+	fail := false
+	b := NewBatch(1, func(i []interface{}) error {
+		if fail {
+			return errors.New("write failed")
+		}
+		return nil
+	})
+
+	commits, rollbacks := 0, 0
+	b.SetCommitEvery(2, func() error {
+		commits++
+		return nil
+	}, func() error {
+		rollbacks++
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commits != 1 {
+		t.Fatal("expected a commit after every second batch, got", commits)
+	}
+
+	// a failure abandons the open group
+	fail = true
+	if err := b.Push(3); err == nil {
+		t.Fatal("expected the handler error")
+	}
+	if rollbacks != 1 || commits != 1 {
+		t.Fatal("expected the group to be rolled back")
+	}
+
+	fail = false
+	if err := b.Push(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 2 {
+		t.Fatal("expected the partial group to be committed on close, got", commits)
+	}
+}
+
+func TestBatch_PushSlice(t *testing.T) {
+	handled := 0
+	b := NewBatch(2, func(i []interface{}) error {
+		if i[0] == 2 {
+			return errors.New("write failed")
+		}
+		handled += len(i)
+		return nil
+	})
+	b.SetBulkAtomic(true)
+
+	// records buffered beforehand are flushed first, so they can't be lost with the slice's batches
+	if err := b.Push(9); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch holding 2 and 3 fails as soon as it fills, so the slice resumes from 2, with nothing after it buffered
+	n, err := b.PushSlice([]interface{}{0, 1, 2, 3, 4, 5, 6})
+	if err == nil || n != 2 {
+		t.Fatal("expected to resume from the failed batch, got", n, err)
+	}
+	if handled != 3 || b.GetPosition() != 0 {
+		t.Fatal("expected the earlier records to be handled, with nothing buffered, got", handled, b.GetPosition())
+	}
+
+	// resuming from the count picks up where the slice left off
+	n, err = b.PushSlice([]interface{}{3, 4, 5})
+	if err != nil || n != 3 || handled != 5 || b.GetPosition() != 1 {
+		t.Fatal("expected the rest of the slice to be accepted, got", n, err, handled)
+	}
+
+	// best-effort pushes everything, reporting the failures
+	b.SetBulkAtomic(false)
+	n, err = b.PushSlice([]interface{}{5, 2, 7, 8, 9})
+	if err == nil || n != 4 {
+		t.Fatal("expected every push but the failed one to succeed, got", n, err)
+	}
+}
+
+func TestBatch_SetPreFlush(t *testing.T) {
+	var handled [][]interface{}
+	b := NewBatch(10, func(i []interface{}) error {
+		handled = append(handled, i)
+		return nil
+	})
+	b.SetManualClock()
+	start := time.Now()
+	if err := b.Tick(start); err != nil {
+		t.Fatal(err)
+	}
+
+	accepting := false
+	b.SetPreFlush(func(batch []interface{}) FlushAction {
+		if batch[0] == "drop" {
+			return Drop
+		}
+		if !accepting {
+			return Delay(time.Minute)
+		}
+		return Proceed
+	})
+
+	if err := b.Push("drop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 0 || b.GetDropped() != 1 {
+		t.Fatal("expected the batch to be dropped")
+	}
+
+	if err := b.Push("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 0 {
+		t.Fatal("expected the batch to be delayed")
+	}
+
+	// still refused when it comes due, so it's delayed again
+	if err := b.Tick(start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 0 {
+		t.Fatal("expected the batch to be delayed again")
+	}
+
+	accepting = true
+	if err := b.Tick(start.Add(90 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Tick(start.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0][0] != "a" {
+		t.Fatal("expected the delayed batch once downstream accepted it, got", handled)
+	}
+
+	// close delivers anything still held
+	accepting = false
+	if err := b.Push("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 2 || handled[1][0] != "b" {
+		t.Fatal("expected close to deliver the held batch, got", handled)
+	}
+}
+
+func TestBatch_SetPreFlush_DiscardOnClose(t *testing.T) {
+	var handled int32
+	b := NewBatch(10, func(i []interface{}) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	b.SetDiscardOnClose(true)
+
+	// a hook that never lets anything through would re-arm its timer forever
+	b.SetPreFlush(func(batch []interface{}) FlushAction {
+		return Delay(5 * time.Millisecond)
+	})
+
+	if err := b.Push("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mutex.Lock()
+	timers, held := len(b.heldTimers), len(b.held)
+	b.mutex.Unlock()
+	if timers != 0 || held != 0 {
+		t.Fatal("expected close to stop the timers and discard the held batch, got", timers, "timers and", held, "batches")
+	}
+
+	// releasing does nothing once closed, even if a timer had already fired
+	if err := b.releaseHeld(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&handled) != 0 {
+		t.Fatal("expected the held batch never to be handled")
+	}
+}
+
+func TestBatch_EstimateBytes(t *testing.T) {
+	b := NewBatch(10, func(i []interface{}) error {
+		return nil
+	})
+	sizeOf := func(record interface{}) int {
+		return len(record.(string))
+	}
+
+	if b.EstimateBytes(sizeOf) != 0 {
+		t.Fatal("expected an unallocated buffer to hold nothing")
+	}
+
+	for _, s := range []string{"abc", "de"} {
+		if err := b.Push(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	estimate := b.EstimateBytes(sizeOf)
+	if estimate <= 5 {
+		t.Fatal("expected the estimate to include the records and the buffer's overhead, got", estimate)
+	}
+}
+
+func TestBatch_LatencyPercentiles(t *testing.T) {
+	b := NewBatch(1, func(i []interface{}) error {
+		return nil
+	})
+
+	if err := b.Push(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.LatencyPercentiles()) != 0 {
+		t.Fatal("expected no percentiles before tracking is enabled")
+	}
+
+	// handler calls are sampled once tracking is enabled
+	b.SetLatencyTracking(true)
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.LatencyPercentiles()) != 3 {
+		t.Fatal("expected percentiles once a handler call was tracked")
+	}
+
+	// with known durations, the percentiles are exact
+	b.SetLatencyTracking(false)
+	b.SetLatencyTracking(true)
+	for i := 100; i >= 1; i-- {
+		b.trackLatency(time.Duration(i) * time.Millisecond)
+	}
+	percentiles := b.LatencyPercentiles()
+	for p, want := range map[float64]time.Duration{0.5: 50 * time.Millisecond, 0.95: 95 * time.Millisecond, 0.99: 99 * time.Millisecond} {
+		if percentiles[p] != want {
+			t.Fatal("expected percentile", p, "to be", want, "got", percentiles[p])
+		}
+	}
+}
+
+// recordingTx records what happened to it, and to the other transactions begun by its beginner
+type recordingTx struct {
+	beginner *recordingBeginner
+}
+
+func (tx *recordingTx) Commit() error {
+	tx.beginner.events = append(tx.beginner.events, "commit")
+	return nil
+}
+
+func (tx *recordingTx) Rollback() error {
+	tx.beginner.events = append(tx.beginner.events, "rollback")
+	return nil
+}
+
+type recordingBeginner struct {
+	events []string
+}
+
+func (b *recordingBeginner) Begin() (Tx, error) {
+	b.events = append(b.events, "begin")
+	return &recordingTx{beginner: b}, nil
+}
+
+func TestBatch_SetTxBeginner(t *testing.T) {
+	beginner := &recordingBeginner{}
+	b := NewBatch(1, nil)
+	b.SetTxBeginner(beginner, func(tx Tx, batch []interface{}) error {
+		if batch[0] == "bad" {
+			return errors.New("write failed")
+		}
+		beginner.events = append(beginner.events, "write")
+		return nil
+	})
+
+	if err := b.Push("good"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push("bad"); err == nil {
+		t.Fatal("expected the handler error")
+	}
+	if events := strings.Join(beginner.events, ","); events != "begin,write,commit,begin,rollback" {
+		t.Fatal("expected a transaction per batch, got", events)
+	}
+
+	// grouped, one transaction spans the group
+	beginner.events = nil
+	b.SetCommitEvery(2, nil)
+	for _, v := range []string{"a", "b", "c"} {
+		if err := b.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if events := strings.Join(beginner.events, ","); events != "begin,write,write,commit,begin,write,commit" {
+		t.Fatal("expected a transaction per group, got", events)
+	}
+}
+
+func TestBatch_SetMaxLifetime(t *testing.T) {
+	b, collected := NewCollectorBatch(10)
+	b.SetManualClock()
+	start := time.Now()
+	if err := b.Tick(start); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := 0
+	b.SetOnClosed(func() {
+		closed++
+	})
+	b.SetMaxLifetime(time.Hour)
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Tick(start.Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 0 {
+		t.Fatal("closed before the lifetime elapsed")
+	}
+
+	if err := b.Tick(start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 || len(collected()) != 1 {
+		t.Fatal("expected the batch to flush and close once its lifetime elapsed")
+	}
+	if err := b.Push(2); err != ErrBatchClosed {
+		t.Fatal("expected pushes to fail after the batch closed, got", err)
+	}
+
+	// closing again doesn't fire the callback again
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatal("expected the closed callback to fire once")
+	}
+}
+
+// recordingLogger keeps every message logged to it
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func TestBatch_SetLogger(t *testing.T) {
+	b, _ := NewCollectorBatch(10)
+	for i := 0; i < 3; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// silent until a logger is set
+	b.Pause()
+	if err := b.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &recordingLogger{}
+	b.SetLogger(logger)
+	b.Pause()
+	if err := b.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "batch paused,batch resumed with 3 buffered records,batch closing, flushing 3 buffered records"
+	if messages := strings.Join(logger.messages, ","); messages != expected {
+		t.Fatal("unexpected log messages:", messages)
+	}
+}
+
+func TestBatch_SetBufferAllocator(t *testing.T) {
+	var handled []interface{}
+	b := NewBatch(2, func(i []interface{}) error {
+		handled = append(handled, i...)
+		return nil
+	})
+
+	var pool [][]interface{}
+	allocated, released := 0, 0
+	b.SetBufferAllocator(func(n int) []interface{} {
+		allocated++
+		if len(pool) > 0 && cap(pool[len(pool)-1]) >= n {
+			buf := pool[len(pool)-1]
+			pool = pool[:len(pool)-1]
+			return buf[:n]
+		}
+		return make([]interface{}, n)
+	}, func(buf []interface{}) {
+		released++
+		for i := range buf {
+			buf[i] = nil
+		}
+		pool = append(pool, buf)
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// buffers outgrown while paused go back to the allocator too
+	b.Pause()
+	for i := 5; i < 10; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handled) != 10 || handled[9] != 9 {
+		t.Fatal("expected every record to be handled, got", handled)
+	}
+	if allocated == 0 || released != allocated-1 {
+		t.Fatal("expected every buffer but the current one to be released, allocated", allocated, "released", released)
+	}
+}
+
+func TestBatch_PushWithAck(t *testing.T) {
+	b := NewBatch(3, func(i []interface{}) error {
+		for _, record := range i {
+			if record == "bad" {
+				return errors.New("bad record")
+			}
+		}
+		return nil
+	})
+	b.SetDedupKey(func(i interface{}) string {
+		return i.(string)
+	})
+
+	var acked [][]interface{}
+	b.SetAck(func(tokens []interface{}) error {
+		acked = append(acked, tokens)
+		return nil
+	})
+
+	// the duplicate's token is acknowledged along with the original's, and the plain push contributes nothing
+	if err := b.PushWithAck("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PushWithAck("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PushWithAck("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PushWithAck("d", 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(acked) != 1 || len(acked[0]) != 3 || acked[0][0] != 1 || acked[0][1] != 2 || acked[0][2] != 3 {
+		t.Fatal("expected the first batch's tokens to be acknowledged, got", acked)
+	}
+
+	// a failed batch isn't acknowledged
+	if err := b.PushWithAck("bad", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err == nil {
+		t.Fatal("expected the failing batch to error")
+	}
+	if len(acked) != 1 {
+		t.Fatal("expected the failed batch not to be acknowledged, got", acked)
+	}
+
+	// ack errors are returned like handler errors
+	b.SetAck(func(tokens []interface{}) error {
+		return errors.New("ack failed")
+	})
+	if err := b.PushWithAck("e", 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err == nil {
+		t.Fatal("expected the ack error to be returned")
+	}
+}
+
+func TestBatch_SetErrorTolerance(t *testing.T) {
+	b := NewBatch(1, func(i []interface{}) error {
+		return errors.New("sink unavailable")
+	})
+	b.SetManualClock()
+	b.SetErrorTolerance(2, time.Minute)
+
+	var warnings int
+	b.SetOnError(func(err error) {
+		warnings++
+	})
+
+	// the first two errors in the window are only warnings
+	for i := 0; i < 2; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal("expected error", i, "to be tolerated, got", err)
+		}
+	}
+	if warnings != 2 {
+		t.Fatal("expected the tolerated errors to reach the OnError hook, got", warnings)
+	}
+	if err := b.Push(2); err == nil {
+		t.Fatal("expected the third error to escalate")
+	}
+
+	// once the window has passed, errors are tolerated again
+	start := b.now()
+	if err := b.Tick(start.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push(3); err != nil {
+		t.Fatal("expected the error to be tolerated after the window, got", err)
+	}
+	if warnings != 3 {
+		t.Fatal("expected three warnings, got", warnings)
+	}
+}
+
+func TestBatch_PushWithAck_CommitEvery(t *testing.T) {
+	b := NewBatch(1, func(i []interface{}) error {
+		if i[0] == "bad" {
+			return errors.New("bad record")
+		}
+		return nil
+	})
+
+	commits, rollbacks := 0, 0
+	b.SetCommitEvery(2, func() error {
+		commits++
+		return nil
+	}, func() error {
+		rollbacks++
+		return nil
+	})
+
+	var acked []interface{}
+	b.SetAck(func(tokens []interface{}) error {
+		acked = append(acked, tokens...)
+		return nil
+	})
+
+	// tokens wait for their group to commit
+	if err := b.PushWithAck("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(acked) != 0 {
+		t.Fatal("expected no ack before the group commits, got", acked)
+	}
+	if err := b.PushWithAck("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 1 || len(acked) != 2 || acked[0] != 1 || acked[1] != 2 {
+		t.Fatal("expected the group's tokens to be acknowledged on commit, got", acked)
+	}
+
+	// a group that rolls back is never acknowledged, including its batches that succeeded
+	if err := b.PushWithAck("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PushWithAck("bad", 4); err == nil {
+		t.Fatal("expected the failing batch to error")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rollbacks != 1 || len(acked) != 2 {
+		t.Fatal("expected the rolled-back group not to be acknowledged, got", acked)
+	}
+}
+
+func TestBatch_SetErrorTolerance_CommitEvery(t *testing.T) {
+	b := NewBatch(1, func(i []interface{}) error {
+		if i[0] == "bad" {
+			return errors.New("bad record")
+		}
+		return nil
+	})
+	b.SetErrorTolerance(5, time.Minute)
+
+	commits, rollbacks := 0, 0
+	failCommit := false
+	b.SetCommitEvery(3, func() error {
+		commits++
+		if failCommit {
+			return errors.New("commit failed")
+		}
+		return nil
+	}, func() error {
+		rollbacks++
+		return nil
+	})
+
+	// a tolerated failure doesn't roll back the batches already handled in its group
+	for _, record := range []string{"a", "bad", "c"} {
+		if err := b.Push(record); err != nil {
+			t.Fatal("expected", record, "to succeed, got", err)
+		}
+	}
+	if commits != 1 || rollbacks != 0 {
+		t.Fatal("expected the group to commit, got", commits, "commits and", rollbacks, "rollbacks")
+	}
+
+	// commit failures are never tolerated
+	failCommit = true
+	for _, record := range []string{"d", "e"} {
+		if err := b.Push(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Push("f"); err == nil {
+		t.Fatal("expected the commit failure to propagate")
+	}
+}
+
+func TestBatch_SetBufferAllocator_HeldOverflow(t *testing.T) {
+	var handled [][]interface{}
+	b := NewBatch(2, func(i []interface{}) error {
+		handled = append(handled, append([]interface{}(nil), i...))
+		return nil
+	})
+	b.SetManualClock()
+	start := b.now()
+
+	var pool [][]interface{}
+	b.SetBufferAllocator(func(n int) []interface{} {
+		if len(pool) > 0 && cap(pool[len(pool)-1]) >= n {
+			buf := pool[len(pool)-1]
+			pool = pool[:len(pool)-1]
+			return buf[:n]
+		}
+		return make([]interface{}, n)
+	}, func(buf []interface{}) {
+		for i := range buf {
+			buf[i] = nil
+		}
+		pool = append(pool, buf)
+	})
+
+	delayed := false
+	b.SetPreFlush(func(batch []interface{}) FlushAction {
+		if !delayed {
+			delayed = true
+			return Delay(time.Minute)
+		}
+		return Proceed
+	})
+
+	// the first overflow batch is held past Resume, while the buffers around it are reused
+	b.Pause()
+	for i := 1; i <= 5; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i <= 102; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Tick(start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[interface{}]int)
+	for _, batch := range handled {
+		for _, record := range batch {
+			seen[record]++
+		}
+	}
+	for _, record := range []interface{}{1, 2, 3, 4, 5, 100, 101, 102} {
+		if seen[record] != 1 {
+			t.Fatal("expected every record to be handled exactly once, got", handled)
+		}
+	}
+	if len(seen) != 8 {
+		t.Fatal("expected nothing else to be handled, got", handled)
+	}
+}
+
+func TestBatch_SetAssertOrder(t *testing.T) {
+	b := NewBatch(10, func(i []interface{}) error {
+		return nil
+	})
+	b.SetAssertOrder(func(prev, next interface{}) bool {
+		return prev.(int) < next.(int)
+	})
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push(2); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("out of order push did not panic")
+		}
+	}()
+	_ = b.Push(1)
+}
+
+func TestBatch_SetSlowFlushThreshold(t *testing.T) {
+	primaryCalls := 0
+	slowCalls := 0
+	b := NewBatch(1, func(i []interface{}) error {
+		primaryCalls++
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	b.SetSlowFlushThreshold(time.Millisecond, func(i []interface{}) error {
+		slowCalls++
+		return nil
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first call reveals the primary is slow, the rest are diverted
+	if primaryCalls != 1 || slowCalls != 4 {
+		t.Fatal("expected slow batches to be diverted, got primary = " + strconv.Itoa(primaryCalls) + ", slow = " + strconv.Itoa(slowCalls))
+	}
+}
+
+func TestBatch_Snapshot(t *testing.T) {
+	b := NewBatch(10, func(i []interface{}) error {
+		return nil
+	})
+	b.SetManualClock()
+	start := time.Now()
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Tick(start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	status := b.Snapshot()
+	if status.Used != 1 || status.Cap != 10 || status.Closed || status.OldestAge < time.Minute {
+		t.Fatalf("unexpected snapshot: %+v", status)
+	}
+}
+
+func TestBatch_Pause(t *testing.T) {
+	var sizes []int
+	b := NewBatch(2, func(i []interface{}) error {
+		sizes = append(sizes, len(i))
+		return nil
+	})
+	b.Pause()
+	b.SetPauseOverflow(5, ErrorOnPauseOverflow)
+
+	for i := 0; i < 5; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Push(5); err != ErrPauseOverflow {
+		t.Fatal("expected the overflow limit to be enforced")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 0 {
+		t.Fatal("handler was called while paused")
+	}
+
+	// the two full batches are delivered on resume, the last record stays buffered
+	if err := b.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || b.GetPosition() != 1 {
+		t.Fatal("full batches were not delivered on resume")
+	}
+}
+
+func TestBatch_FlushReturn(t *testing.T) {
+	b := NewBatch(10, func(i []interface{}) error {
+		i[0] = nil
+		return nil
+	})
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push(2); err != nil {
+		t.Fatal(err)
+	}
+
+	processed, err := b.FlushReturn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processed) != 2 || processed[0] != 1 || processed[1] != 2 {
+		t.Fatal("flush did not return the processed records")
+	}
+
+	if processed, err = b.FlushReturn(); err != nil || processed != nil {
+		t.Fatal("empty flush should return nothing")
+	}
+}
+
+func TestMemoryMonitor(t *testing.T) {
+	var flushCount int32
+	handler := func(i []interface{}) error {
+		atomic.AddInt32(&flushCount, 1)
+		return nil
+	}
+	m := NewMemoryMonitor(1000)
+	m.SetManualClock()
+
+	probes, usage := 0, uint64(100)
+	m.SetProbe(func() uint64 {
+		probes++
+		return usage
+	})
+
+	var batches []*Batch
+	for i := 0; i < 3; i++ {
+		b := NewBatch(10, handler)
+		b.JoinMemoryMonitor(m)
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, b)
+	}
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&flushCount) != 0 {
+		t.Fatal("flushed while under the memory limit")
+	}
+
+	// one probe serves every joined batch, and closed batches leave the monitor
+	usage = 2000
+	if err := batches[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if probes != 2 {
+		t.Fatal("expected one probe per check, got", probes)
+	}
+	if count := atomic.LoadInt32(&flushCount); count != 3 {
+		t.Fatal("expected every open batch to flush over the memory limit, got", count)
+	}
+	m.mutex.Lock()
+	joined := len(m.batches)
+	m.mutex.Unlock()
+	if joined != 2 {
+		t.Fatal("expected the closed batch to leave the monitor, got", joined, "batches")
+	}
+
+	// a non-positive check interval falls back to the default
+	m.SetCheckInterval(0)
+	if m.interval != defaultMemoryCheckInterval {
+		t.Fatal("expected the default check interval, got", m.interval)
+	}
+}
+
+func TestMemoryMonitor_Background(t *testing.T) {
+	flushed := make(chan struct{}, 1)
+	b := NewBatch(10, func(i []interface{}) error {
+		flushed <- struct{}{}
+		return nil
+	})
+	m := NewMemoryMonitor(1)
+	m.SetCheckInterval(time.Millisecond)
+	m.SetProbe(func() uint64 {
+		return 2
+	})
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	b.JoinMemoryMonitor(m)
+	defer b.LeaveMemoryMonitor(m)
+
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background check did not flush the batch")
+	}
+}
+
+func TestBatch_SetDiscardOnClose(t *testing.T) {
+	flushCount := 0
+	b := NewBatch(10, func(i []interface{}) error {
+		flushCount++
+		return nil
+	})
+	b.SetDiscardOnClose(true)
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if flushCount != 0 || b.GetPosition() != 0 {
+		t.Fatal("close did not discard the buffered record")
+	}
+	if err := b.Push(2); err != ErrBatchClosed {
+		t.Fatal("batch was not marked closed")
+	}
+}
+
+func TestBatch_SetBackoff(t *testing.T) {
+	attempts := 0
+	b := NewBatch(1, func(i []interface{}) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	b.SetBackoff(func() Backoff {
+		return &ExponentialBackoff{Initial: time.Millisecond, MaxRetries: 5}
+	})
+
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatal("expected 3 attempts, got " + strconv.Itoa(attempts))
+	}
+
+	// a cancelled context abandons the retry
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.SetContext(ctx)
+	attempts = 0
+	if err := b.Push(2); err == nil || attempts != 1 {
+		t.Fatal("expected the retry to be abandoned")
+	}
+
+	// without an initial wait, retrying forever still waits between attempts
+	backoff := &ExponentialBackoff{}
+	for i, want := range []time.Duration{defaultInitialBackoff, 2 * defaultInitialBackoff, 4 * defaultInitialBackoff} {
+		if delay, ok := backoff.Next(); !ok || delay != want {
+			t.Fatal("expected retry", i, "to wait", want, "got", delay, ok)
+		}
+	}
+}
+
+func TestBatch_SetDedupEqual(t *testing.T) {
+	type row struct {
+		id, version int
+	}
+
+	var flushed []interface{}
+	b := NewBatch(10, func(i []interface{}) error {
+		flushed = append(flushed, i...)
+		return nil
+	})
+	b.SetDedupEqual(func(a, b interface{}) bool {
+		return a.(row).id == b.(row).id
+	})
+
+	for _, r := range []row{{1, 1}, {2, 1}, {1, 2}} {
+		if err := b.Push(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(flushed) != 2 || flushed[0].(row).version != 2 {
+		t.Fatal("duplicate was not replaced in place")
+	}
+
+	// the key path behaves the same way
+	flushed = nil
+	b.SetDedupKey(func(i interface{}) string {
+		return strconv.Itoa(i.(row).id)
+	})
+	for _, r := range []row{{1, 1}, {2, 1}, {2, 2}} {
+		if err := b.Push(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 2 || flushed[1].(row).version != 2 {
+		t.Fatal("duplicate was not replaced by key")
+	}
+}
+
+func TestBatch_SetBatchTransform(t *testing.T) {
+	var flushed []interface{}
+	b := NewBatch(10, func(i []interface{}) error {
+		flushed = i
+		return nil
+	})
+	b.SetBatchTransform(func(i []interface{}) ([]interface{}, error) {
+		sort.Slice(i, func(x, y int) bool {
+			return i[x].(int) < i[y].(int)
+		})
+		return i, nil
+	})
+
+	for _, v := range []int{3, 1, 2} {
+		if err := b.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if flushed[0] != 1 || flushed[2] != 3 {
+		t.Fatal("batch was not transformed before the handler")
+	}
+
+	b.SetBatchTransform(func(i []interface{}) ([]interface{}, error) {
+		return nil, errors.New("transform failed")
+	})
+	if err := b.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err == nil {
+		t.Fatal("transform error was not returned")
+	}
+}
+
+func TestBatch_BatchError(t *testing.T) {
+	errFailed := errors.New("failed")
+	b := NewBatch(1, func(i []interface{}) error {
+		return errFailed
+	})
+
+	err := b.Push(1)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Seq != 1 || batchErr.Len != 1 || batchErr.Time.IsZero() {
+		t.Fatal("expected a BatchError for the first batch")
+	}
+	if !errors.Is(err, errFailed) {
+		t.Fatal("BatchError did not unwrap to the handler error")
+	}
+
+	if err := b.Push(2); !errors.As(err, &batchErr) || batchErr.Seq != 2 {
+		t.Fatal("sequence number did not advance")
+	}
+}
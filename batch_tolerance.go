@@ -0,0 +1,54 @@
+package work
+
+import "time"
+
+// SetErrorTolerance treats handler errors as warnings until more than maxErrors of them happen within window - for
+// noisy-but-nonfatal sinks, where transient blips shouldn't fail the caller but sustained failures should.  A tolerated
+// error goes to the OnError hook (and the logger) instead of being returned, so the Push, Flush or Close that handled
+// the batch succeeds - but the batch's records are still lost, and aren't acknowledged.  Every error counts toward the
+// window, including those that escalated.  Backoff retries happen first, so only a batch's final error is counted.
+// Windows are measured on the batch's clock.  Zero maxErrors (the default) tolerates nothing.  Only handler errors are
+// tolerated: with SetCommitEvery, a tolerated failure counts as a handled call, so it doesn't roll back its group, which
+// goes on to commit (along with anything the failed handler had written to the group's transaction), while errors
+// from committing or rolling back always propagate.
+func (b *Batch) SetErrorTolerance(maxErrors int, window time.Duration) {
+	b.mutex.Lock()
+	b.maxErrors = maxErrors
+	b.toleranceWindow = window
+	b.recentErrors = nil
+	b.mutex.Unlock()
+}
+
+// tolerate reports whether a handler error is within the error tolerance, having reported it as a warning if so
+func (b *Batch) tolerate(err error) bool {
+	b.mutex.Lock()
+	if b.maxErrors <= 0 {
+		b.mutex.Unlock()
+		return false
+	}
+
+	// forget errors that have fallen out of the window
+	now := b.now()
+	kept := b.recentErrors[:0]
+	for _, at := range b.recentErrors {
+		if now.Sub(at) < b.toleranceWindow {
+			kept = append(kept, at)
+		}
+	}
+	b.recentErrors = append(kept, now)
+
+	// beyond the tolerance, older errors don't change the outcome
+	if len(b.recentErrors) > b.maxErrors+1 {
+		b.recentErrors = b.recentErrors[1:]
+	}
+	count := len(b.recentErrors)
+	tolerated := count <= b.maxErrors
+	b.mutex.Unlock()
+
+	if !tolerated {
+		return false
+	}
+	b.logf("batch tolerating handler error %d of %d within %s: %v", count, b.maxErrors, b.toleranceWindow, err)
+	b.reportError(err)
+	return true
+}
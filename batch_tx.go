@@ -0,0 +1,69 @@
+package work
+
+// Tx is a sink's transaction, as begun by a TxBeginner
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+// TxBeginner begins transactions against a sink (e.g. an adapter over *sql.DB)
+type TxBeginner interface {
+	Begin() (Tx, error)
+}
+
+// TxBatchHandler handles a batch within a transaction
+type TxBatchHandler func(tx Tx, batch []interface{}) error
+
+// SetTxBeginner runs each batch through handler within a freshly-begun transaction - committed when the handler
+// succeeds, rolled back when it fails - replacing the push and flush handlers.  With SetCommitEvery, the transaction
+// spans the whole group instead: it's begun by the group's first batch, and committed (before the commit callback runs,
+// which may then be nil) or rolled back along with the group.
+func (b *Batch) SetTxBeginner(beginner TxBeginner, handler TxBatchHandler) {
+	txHandler := func(items []interface{}) error {
+		tx, grouped, err := b.beginTx(beginner)
+		if err != nil {
+			return err
+		}
+
+		err = handler(tx, items)
+
+		// a group's transaction is finished along with the group
+		if grouped {
+			return err
+		}
+
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return MultiError{err, rollbackErr}
+			}
+			return err
+		}
+		return tx.Commit()
+	}
+
+	b.mutex.Lock()
+	b.pushHandler = txHandler
+	b.flushHandler = txHandler
+	b.mutex.Unlock()
+}
+
+// beginTx returns the transaction a batch should be handled in, also reporting whether it belongs to a group - a
+// group's transaction is begun by its first batch
+func (b *Batch) beginTx(beginner TxBeginner) (Tx, bool, error) {
+	b.commitMutex.Lock()
+	defer b.commitMutex.Unlock()
+
+	if b.commitEvery <= 0 {
+		tx, err := beginner.Begin()
+		return tx, false, err
+	}
+
+	if b.groupTx == nil {
+		tx, err := beginner.Begin()
+		if err != nil {
+			return nil, true, err
+		}
+		b.groupTx = tx
+	}
+	return b.groupTx, true, nil
+}
@@ -0,0 +1,60 @@
+package work
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// Codec compresses serialized batches for CompressingHandler - implement it to plug in other algorithms (zstd, etc.)
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+}
+
+// GzipCodec compresses with gzip, at the given level (zero uses gzip's default level)
+type GzipCodec struct {
+	Level int
+}
+
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NoopCodec passes data through uncompressed
+type NoopCodec struct{}
+
+func (NoopCodec) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// CompressingHandler adapts a byte-oriented sink into a batch handler - each batch is serialized with marshal, then
+// compressed with codec, and the result is handed to h
+func CompressingHandler(h func([]byte) error, marshal func([]interface{}) ([]byte, error), codec Codec) BatchHandler {
+	return func(items []interface{}) error {
+		data, err := marshal(items)
+		if err != nil {
+			return err
+		}
+
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			return err
+		}
+		return h(compressed)
+	}
+}
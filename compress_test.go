@@ -0,0 +1,52 @@
+package work
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressingHandler(t *testing.T) {
+	marshal := func(items []interface{}) ([]byte, error) {
+		return json.Marshal(items)
+	}
+
+	var payload []byte
+	b := NewBatch(2, CompressingHandler(func(data []byte) error {
+		payload = data
+		return nil
+	}, marshal, GzipCodec{}))
+
+	for _, v := range []string{"a", "b"} {
+		if err := b.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["a","b"]` {
+		t.Fatal("expected the serialized batch to be compressed, got", string(data))
+	}
+
+	if err := CompressingHandler(func(data []byte) error {
+		payload = data
+		return nil
+	}, marshal, NoopCodec{})([]interface{}{1}); err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `[1]` {
+		t.Fatal("expected the no-op codec to pass the serialized batch through, got", string(payload))
+	}
+}
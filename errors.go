@@ -0,0 +1,48 @@
+package work
+
+import (
+	"strconv"
+	"time"
+)
+
+// MultiError aggregates the errors from an operation that spans several batches
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+
+	msg := strconv.Itoa(len(m)) + " errors occurred:"
+	for _, err := range m {
+		msg += " " + err.Error() + ";"
+	}
+	return msg[:len(msg)-1]
+}
+
+// errorOrNil returns nil for an empty MultiError, so callers don't end up with a non-nil error interface holding nothing
+func (m MultiError) errorOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// BatchError wraps an error from handling a batch (whether from the push handler, the flush handler, or anything
+// applied around them) with details for correlating the failure - Seq is the batch's sequence number (counting every
+// batch handed to a handler, from 1), Time is when it failed, and Len is how many records it held
+type BatchError struct {
+	Seq  int
+	Time time.Time
+	Len  int
+	Err  error
+}
+
+func (e *BatchError) Error() string {
+	return "batch " + strconv.Itoa(e.Seq) + " (" + strconv.Itoa(e.Len) + " records) failed at " +
+		e.Time.Format(time.RFC3339Nano) + ": " + e.Err.Error()
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,74 @@
+package work
+
+import "sync"
+
+// FlushGroup awaits asynchronous flushes across a group of batches - like a Barrier, but the flushes are started
+// without waiting on them, so the supervising code can carry on and later Wait for all of them, in one place
+type FlushGroup struct {
+	batches map[*Batch]bool
+	mutex   sync.Mutex
+	errs    MultiError
+
+	// the number of flushes started but not yet completed, with done signalled as each completes
+	pending int
+	done    *sync.Cond
+}
+
+func NewFlushGroup() *FlushGroup {
+	g := &FlushGroup{
+		batches: make(map[*Batch]bool),
+	}
+	g.done = sync.NewCond(&g.mutex)
+	return g
+}
+
+// JoinFlushGroup adds the batch to the group, so it is flushed whenever the group is
+func (b *Batch) JoinFlushGroup(group *FlushGroup) {
+	group.mutex.Lock()
+	group.batches[b] = true
+	group.mutex.Unlock()
+}
+
+// LeaveFlushGroup removes the batch from the group - any of its flushes that are outstanding are still waited on
+func (b *Batch) LeaveFlushGroup(group *FlushGroup) {
+	group.mutex.Lock()
+	delete(group.batches, b)
+	group.mutex.Unlock()
+}
+
+// Flush starts flushing every joined batch concurrently, returning without waiting for the flushes to complete.  Like
+// Barrier.Flush, it applies to the batches joined when it's called, and batches that have already been closed are
+// skipped.  It may be called concurrently with Wait.
+func (g *FlushGroup) Flush() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.pending += len(g.batches)
+	for b := range g.batches {
+		go func(b *Batch) {
+			err := b.Flush()
+
+			g.mutex.Lock()
+			if err != nil && err != ErrBatchClosed {
+				g.errs = append(g.errs, err)
+			}
+			g.pending--
+			g.done.Broadcast()
+			g.mutex.Unlock()
+		}(b)
+	}
+}
+
+// Wait returns once every flush the group has started has completed, with any errors from them aggregated into a
+// MultiError - the errors are cleared, so a later Wait only reports flushes completed after this one returned.  Flushes
+// started while it's waiting (by a concurrent Flush) are waited on too.
+func (g *FlushGroup) Wait() error {
+	g.mutex.Lock()
+	for g.pending > 0 {
+		g.done.Wait()
+	}
+	errs := g.errs
+	g.errs = nil
+	g.mutex.Unlock()
+	return errs.errorOrNil()
+}
@@ -0,0 +1,89 @@
+package work
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlushGroup_Wait(t *testing.T) {
+	var flushed int32
+	release := make(chan bool)
+	handler := func(i []interface{}) error {
+		<-release
+		atomic.AddInt32(&flushed, int32(len(i)))
+		return nil
+	}
+
+	group := NewFlushGroup()
+	b1 := NewBatch(10, handler)
+	b2 := NewBatch(10, handler)
+	b3 := NewBatch(10, func(i []interface{}) error {
+		return errors.New("failed")
+	})
+	for _, b := range []*Batch{b1, b2, b3} {
+		b.JoinFlushGroup(group)
+		if err := b.Push(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the flushes are still blocked in their handlers when Flush returns
+	group.Flush()
+	if atomic.LoadInt32(&flushed) != 0 {
+		t.Fatal("expected Flush not to wait on the flushes")
+	}
+	close(release)
+
+	err := group.Wait()
+	if multi, ok := err.(MultiError); !ok || len(multi) != 1 {
+		t.Fatal("expected a single aggregated error, got", err)
+	}
+	if atomic.LoadInt32(&flushed) != 2 {
+		t.Fatal("joined batches were not flushed")
+	}
+
+	b3.LeaveFlushGroup(group)
+	group.Flush()
+	if err := group.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushGroup_ConcurrentFlush(t *testing.T) {
+	group := NewFlushGroup()
+	for i := 0; i < 4; i++ {
+		b := NewBatch(10, func(i []interface{}) error {
+			return nil
+		})
+		b.JoinFlushGroup(group)
+	}
+
+	// Flush and Wait running side by side is fine, and a final Wait sees every flush through
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := group.Wait(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 100; i++ {
+		group.Flush()
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	group.mutex.Lock()
+	pending := group.pending
+	group.mutex.Unlock()
+	if pending != 0 {
+		t.Fatal("expected no flushes to be outstanding, got", pending)
+	}
+}
@@ -0,0 +1,248 @@
+package work
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultIdleKeyTimeout is how long a key's empty group is kept around after its last use
+const defaultIdleKeyTimeout = time.Minute
+
+// GroupedBatch batches records separately per key (e.g. per tenant), so each key's records are handed to the handler
+// together - each key gets its own batch, created on first use
+type GroupedBatch struct {
+	batchSize int
+	keyFn     func(interface{}) string
+	handler   func(key string, items []interface{}) error
+
+	mutex          sync.Mutex
+	groups         map[string]*group
+	rateLimit      float64
+	idleKeyTimeout time.Duration
+	lastSweep      time.Time
+	closed         bool
+
+	// the clock set by Tick, when using a manual clock, with ticked signalled whenever it advances
+	manualClock bool
+	manualNow   time.Time
+	ticked      *sync.Cond
+}
+
+// group is a single key's batch, along with its flush throttling
+type group struct {
+	batch    *Batch
+	limiter  *tokenBucket
+	inFlight int
+	lastUsed time.Time
+}
+
+func NewGroupedBatch(batchSize int, keyFn func(interface{}) string, handler func(key string, items []interface{}) error) *GroupedBatch {
+	g := &GroupedBatch{
+		batchSize:      batchSize,
+		keyFn:          keyFn,
+		handler:        handler,
+		groups:         make(map[string]*group),
+		idleKeyTimeout: defaultIdleKeyTimeout,
+		lastSweep:      time.Now(),
+	}
+	g.ticked = sync.NewCond(&g.mutex)
+	return g
+}
+
+// SetPerKeyRateLimit throttles each key's handler calls to rps per second, independently of other keys, so one key can't
+// consume all of the downstream write budget - a key's pushes block while its next batch waits its turn.  Zero (the
+// default) disables the limit.
+func (g *GroupedBatch) SetPerKeyRateLimit(rps float64) {
+	g.mutex.Lock()
+	g.rateLimit = rps
+	for _, grp := range g.groups {
+		grp.limiter = nil
+	}
+	g.mutex.Unlock()
+}
+
+// SetIdleKeyTimeout sets how long a key with nothing buffered is kept after its last push - the key's state is then
+// discarded, so the set of keys doesn't grow without bound.  The default is a minute.
+func (g *GroupedBatch) SetIdleKeyTimeout(d time.Duration) {
+	g.mutex.Lock()
+	g.idleKeyTimeout = d
+	g.mutex.Unlock()
+}
+
+// SetManualClock makes the grouped batch's time-based behavior (rate limiting and discarding idle keys) follow a clock
+// advanced by Tick, rather than the wall clock - a throttled key's pushes then block until Tick moves the clock past
+// its next turn, which makes the timing deterministic to test.  Like Batch.SetManualClock, the clock starts at the
+// current time.
+func (g *GroupedBatch) SetManualClock() {
+	g.mutex.Lock()
+	g.manualClock = true
+	g.manualNow = time.Now()
+	g.mutex.Unlock()
+}
+
+// Tick advances the manual clock to now, releasing any throttled pushes whose turn has come and discarding idle keys
+func (g *GroupedBatch) Tick(now time.Time) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.manualClock {
+		return errors.New("tick called on grouped batch without a manual clock")
+	}
+	g.manualNow = now
+	g.ticked.Broadcast()
+	g.sweepLocked(now)
+	return nil
+}
+
+// nowLocked returns the current time, per the manual clock if one is in use - the caller must hold the lock
+func (g *GroupedBatch) nowLocked() time.Time {
+	if g.manualClock {
+		return g.manualNow
+	}
+	return time.Now()
+}
+
+// Push adds the record to its key's batch
+func (g *GroupedBatch) Push(record interface{}) error {
+	key := g.keyFn(record)
+
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		return ErrBatchClosed
+	}
+
+	now := g.nowLocked()
+	g.sweepLocked(now)
+	grp := g.groups[key]
+	if grp == nil {
+		grp = &group{}
+		grp.batch = NewBatch(g.batchSize, func(items []interface{}) error {
+			g.throttle(grp)
+			return g.handler(key, items)
+		})
+		g.groups[key] = grp
+	}
+	grp.inFlight++
+	grp.lastUsed = now
+	g.mutex.Unlock()
+
+	err := grp.batch.Push(record)
+
+	g.mutex.Lock()
+	grp.inFlight--
+	g.mutex.Unlock()
+	return err
+}
+
+// Flush flushes every key's batch, aggregating any errors into a MultiError
+func (g *GroupedBatch) Flush() error {
+	var errs MultiError
+	for _, b := range g.batches() {
+		if err := b.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Close closes every key's batch, flushing what remains, and aggregating any errors into a MultiError - later pushes
+// fail with ErrBatchClosed
+func (g *GroupedBatch) Close() error {
+	g.mutex.Lock()
+	g.closed = true
+	g.mutex.Unlock()
+
+	var errs MultiError
+	for _, b := range g.batches() {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// batches returns the current batch of every key
+func (g *GroupedBatch) batches() []*Batch {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	batches := make([]*Batch, 0, len(g.groups))
+	for _, grp := range g.groups {
+		batches = append(batches, grp.batch)
+	}
+	return batches
+}
+
+// throttle waits until the group's rate limit allows another handler call
+func (g *GroupedBatch) throttle(grp *group) {
+	g.mutex.Lock()
+	if g.rateLimit <= 0 {
+		g.mutex.Unlock()
+		return
+	}
+	now := g.nowLocked()
+	if grp.limiter == nil {
+		grp.limiter = newTokenBucket(g.rateLimit, now)
+	}
+	delay := grp.limiter.reserve(now)
+	if !g.manualClock {
+		g.mutex.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		return
+	}
+
+	ready := now.Add(delay)
+	for g.manualNow.Before(ready) {
+		g.ticked.Wait()
+	}
+	g.mutex.Unlock()
+}
+
+// sweepLocked discards the groups of keys that have been idle, with nothing buffered, for the idle timeout - the caller
+// must hold the lock
+func (g *GroupedBatch) sweepLocked(now time.Time) {
+	if now.Sub(g.lastSweep) < g.idleKeyTimeout {
+		return
+	}
+	g.lastSweep = now
+
+	for key, grp := range g.groups {
+		if grp.inFlight == 0 && now.Sub(grp.lastUsed) >= g.idleKeyTimeout && grp.batch.GetPosition() == 0 {
+			delete(g.groups, key)
+		}
+	}
+}
+
+// tokenBucket is a simple rate limiter, allowing a burst of one - it's guarded by the grouped batch's lock, and told the
+// time rather than reading the clock, so it follows a manual clock
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: 1, last: now}
+}
+
+// reserve takes a token, returning how long after now the caller must wait before it's available - waiters reserve
+// their token up front, so they're served in the order they arrived
+func (t *tokenBucket) reserve(now time.Time) time.Duration {
+	if now.After(t.last) {
+		t.tokens += now.Sub(t.last).Seconds() * t.rate
+		if t.tokens > 1 {
+			t.tokens = 1
+		}
+		t.last = now
+	}
+	t.tokens--
+
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
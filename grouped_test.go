@@ -0,0 +1,161 @@
+package work
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupedBatch(t *testing.T) {
+	var mutex sync.Mutex
+	handled := map[string]int{}
+	g := NewGroupedBatch(2, func(record interface{}) string {
+		return record.(string)[:1]
+	}, func(key string, items []interface{}) error {
+		mutex.Lock()
+		handled[key] += len(items)
+		mutex.Unlock()
+		return nil
+	})
+
+	for _, v := range []string{"a1", "b1", "a2", "a3", "b2"} {
+		if err := g.Push(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if handled["a"] != 3 || handled["b"] != 2 {
+		t.Fatal("expected each key's records to be batched separately, got", handled)
+	}
+}
+
+func TestGroupedBatch_SetPerKeyRateLimit(t *testing.T) {
+	var calls sync.Map
+	g := NewGroupedBatch(1, func(record interface{}) string {
+		return record.(string)
+	}, func(key string, items []interface{}) error {
+		count, _ := calls.LoadOrStore(key, new(int32))
+		atomic.AddInt32(count.(*int32), 1)
+		return nil
+	})
+	g.SetManualClock()
+	g.SetPerKeyRateLimit(10)
+	start := g.manualNow
+	callsFor := func(key string) int32 {
+		count, ok := calls.Load(key)
+		if !ok {
+			return 0
+		}
+		return atomic.LoadInt32(count.(*int32))
+	}
+
+	// the first call for a key is free, later ones wait their turn
+	if err := g.Push("a"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := g.Push("a"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// wait for the second push to reserve its turn, due 100ms in
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		g.mutex.Lock()
+		reserved := g.groups["a"].limiter.tokens < 0
+		g.mutex.Unlock()
+		if reserved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the second push to wait its turn")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// other keys have their own budget
+	if err := g.Push("b"); err != nil {
+		t.Fatal(err)
+	}
+	if callsFor("b") != 1 || callsFor("a") != 1 {
+		t.Fatal("expected another key not to be throttled, with the first still waiting its turn")
+	}
+
+	// the third push's turn comes 100ms after the second's
+	if err := g.Tick(start.Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Tick(start.Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the throttled pushes to complete once the clock passed their turn")
+	}
+	if callsFor("a") != 3 {
+		t.Fatal("expected every push of the throttled key to be handled, got", callsFor("a"))
+	}
+}
+
+func TestGroupedBatch_tokenBucket(t *testing.T) {
+	start := time.Now()
+	limiter := newTokenBucket(10, start)
+
+	// waiters are spaced by the rate, in the order they reserve
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if delay := limiter.reserve(start); delay != want {
+			t.Fatal("expected reservation", i, "to wait", want, "got", delay)
+		}
+	}
+
+	// the bucket refills with time, holding at most one token
+	if delay := limiter.reserve(start.Add(time.Second)); delay != 0 {
+		t.Fatal("expected a refilled bucket not to wait, got", delay)
+	}
+	if delay := limiter.reserve(start.Add(time.Second)); delay != 100*time.Millisecond {
+		t.Fatal("expected a burst of one, got a wait of", delay)
+	}
+}
+
+func TestGroupedBatch_SetIdleKeyTimeout(t *testing.T) {
+	g := NewGroupedBatch(1, func(record interface{}) string {
+		return record.(string)
+	}, func(key string, items []interface{}) error {
+		return nil
+	})
+	g.SetManualClock()
+	g.SetIdleKeyTimeout(10 * time.Millisecond)
+	start := g.manualNow
+
+	if err := g.Push("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Tick(start.Add(5 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.batches()) != 1 {
+		t.Fatal("expected the key to be kept until the idle timeout")
+	}
+	if err := g.Tick(start.Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Push("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.batches()) != 1 {
+		t.Fatal("expected the idle key to be discarded")
+	}
+}
@@ -0,0 +1,71 @@
+package work
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// ShardedBatch distributes records across k batches by a hash of their key, each flushing independently to its own
+// handler - for writing in parallel over k identical sink connections, while keeping records with the same key on the
+// same shard (and so in order)
+type ShardedBatch struct {
+	shards []*Batch
+	keyFn  func(interface{}) string
+}
+
+// NewShardedBatch creates k shards of the given batch size, where shard i hands its batches to handlers[i] - it panics
+// unless there's exactly one handler per shard
+func NewShardedBatch(k int, keyFn func(interface{}) string, size int, handlers []BatchHandler) *ShardedBatch {
+	if k < 1 || len(handlers) != k {
+		panic("sharded batch needs one handler per shard, got " + strconv.Itoa(len(handlers)) + " for " + strconv.Itoa(k) + " shards")
+	}
+
+	s := &ShardedBatch{
+		shards: make([]*Batch, k),
+		keyFn:  keyFn,
+	}
+	for i, handler := range handlers {
+		s.shards[i] = NewBatch(size, handler)
+	}
+	return s
+}
+
+// Shard returns the i'th shard's batch, for configuring it or reading its state
+func (s *ShardedBatch) Shard(i int) *Batch {
+	return s.shards[i]
+}
+
+// Push adds the record to the shard its key hashes to
+func (s *ShardedBatch) Push(record interface{}) error {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s.keyFn(record)))
+	return s.shards[h.Sum32()%uint32(len(s.shards))].Push(record)
+}
+
+// Flush flushes every shard concurrently, aggregating any errors into a MultiError
+func (s *ShardedBatch) Flush() error {
+	return s.each((*Batch).Flush)
+}
+
+// Close closes every shard concurrently, flushing what remains, and aggregating any errors into a MultiError
+func (s *ShardedBatch) Close() error {
+	return s.each((*Batch).Close)
+}
+
+// each runs fn on every shard concurrently, aggregating any errors into a MultiError
+func (s *ShardedBatch) each(fn func(*Batch) error) error {
+	errs := make(chan error, len(s.shards))
+	for _, shard := range s.shards {
+		go func(shard *Batch) {
+			errs <- fn(shard)
+		}(shard)
+	}
+
+	var multi MultiError
+	for range s.shards {
+		if err := <-errs; err != nil {
+			multi = append(multi, err)
+		}
+	}
+	return multi.errorOrNil()
+}
@@ -0,0 +1,53 @@
+package work
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestShardedBatch(t *testing.T) {
+	var mutex sync.Mutex
+	keysByShard := make([]map[string]bool, 3)
+	handlers := make([]BatchHandler, 3)
+	for i := range handlers {
+		shard := i
+		keysByShard[shard] = map[string]bool{}
+		handlers[i] = func(items []interface{}) error {
+			mutex.Lock()
+			for _, item := range items {
+				keysByShard[shard][item.(string)] = true
+			}
+			mutex.Unlock()
+			return nil
+		}
+	}
+
+	s := NewShardedBatch(3, func(record interface{}) string {
+		return record.(string)
+	}, 4, handlers)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for round := 0; round < 3; round++ {
+		for _, key := range keys {
+			if err := s.Push(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every key lands on exactly one shard
+	for _, key := range keys {
+		shards := 0
+		for _, seen := range keysByShard {
+			if seen[key] {
+				shards++
+			}
+		}
+		if shards != 1 {
+			t.Fatal("expected key", key, "on exactly one shard, found it on", shards)
+		}
+	}
+}
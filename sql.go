@@ -0,0 +1,60 @@
+package work
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// SQLBatchHandler adapts a database write into a batch handler, without tying the batch to any driver - exec is handed
+// each batch along with ctx, and typically builds a multi-row INSERT from it (see InsertPlaceholders) to run with
+// ExecContext.  Once ctx is done, batches fail with ctx's error without calling exec, and exec should pass ctx through
+// to the driver so a write in progress is canceled too.  Errors from exec are returned as-is (so the driver's error
+// types can still be inspected with errors.As, through the batch's BatchError).  For a transaction per batch, see
+// SetTxBeginner instead.
+func SQLBatchHandler(ctx context.Context, exec func(ctx context.Context, batch []interface{}) error) BatchHandler {
+	return func(items []interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return exec(ctx, items)
+	}
+}
+
+// PlaceholderStyle is how a database driver expects bind parameters to be written
+type PlaceholderStyle int
+
+const (
+	// QuestionPlaceholders writes each parameter as "?" (MySQL, SQLite)
+	QuestionPlaceholders PlaceholderStyle = iota
+
+	// DollarPlaceholders numbers the parameters "$1", "$2" and so on (PostgreSQL)
+	DollarPlaceholders
+)
+
+// InsertPlaceholders returns the VALUES list of a multi-row INSERT for the given number of rows and columns, e.g.
+// "(?, ?), (?, ?)" for two rows of two columns - the arguments to execute it with are the rows' column values,
+// flattened in row order
+func InsertPlaceholders(rows, columns int, style PlaceholderStyle) string {
+	var sb strings.Builder
+	n := 0
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for column := 0; column < columns; column++ {
+			if column > 0 {
+				sb.WriteString(", ")
+			}
+			n++
+			if style == DollarPlaceholders {
+				sb.WriteString("$" + strconv.Itoa(n))
+			} else {
+				sb.WriteByte('?')
+			}
+		}
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
@@ -0,0 +1,55 @@
+package work
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSQLBatchHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dbErr := errors.New("duplicate key")
+
+	var statements []string
+	var args [][]interface{}
+	b := NewBatch(2, SQLBatchHandler(ctx, func(ctx context.Context, batch []interface{}) error {
+		statements = append(statements, "INSERT INTO t (id) VALUES "+InsertPlaceholders(len(batch), 1, DollarPlaceholders))
+		args = append(args, batch)
+		if batch[0] == 3 {
+			return dbErr
+		}
+		return nil
+	}))
+
+	for i := 1; i <= 3; i++ {
+		if err := b.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(statements) != 1 || statements[0] != "INSERT INTO t (id) VALUES ($1), ($2)" || len(args[0]) != 2 {
+		t.Fatal("unexpected statements:", statements)
+	}
+
+	// driver errors come back through the batch's error
+	if err := b.Flush(); !errors.Is(err, dbErr) {
+		t.Fatal("expected the database error, got", err)
+	}
+
+	// once canceled, exec isn't called
+	cancel()
+	if err := b.Push(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); !errors.Is(err, context.Canceled) || len(statements) != 2 {
+		t.Fatal("expected the flush to be canceled, got", err)
+	}
+}
+
+func TestInsertPlaceholders(t *testing.T) {
+	if got := InsertPlaceholders(2, 3, QuestionPlaceholders); got != "(?, ?, ?), (?, ?, ?)" {
+		t.Fatal("unexpected placeholders:", got)
+	}
+	if got := InsertPlaceholders(2, 2, DollarPlaceholders); got != "($1, $2), ($3, $4)" {
+		t.Fatal("unexpected placeholders:", got)
+	}
+}
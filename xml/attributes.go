@@ -0,0 +1,93 @@
+package xml
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// DuplicateAttributePolicy determines how the reader's attribute helpers treat an attribute repeated on one element
+type DuplicateAttributePolicy int
+
+const (
+	// FirstDuplicateAttribute uses the first occurrence of the attribute (the default)
+	FirstDuplicateAttribute DuplicateAttributePolicy = iota
+
+	// LastDuplicateAttribute uses the last occurrence of the attribute
+	LastDuplicateAttribute
+
+	// ErrorOnDuplicateAttribute fails with a *DuplicateAttributeError
+	ErrorOnDuplicateAttribute
+)
+
+// DuplicateAttributeError is returned under ErrorOnDuplicateAttribute when an element repeats an attribute
+type DuplicateAttributeError struct {
+	Element string
+
+	// Attribute is the repeated attribute's name, in "{uri}local" form when it's in a namespace
+	Attribute string
+
+	// Offset is the input offset when the attributes were read - just after the element's start tag, when they're read
+	// as soon as the element starts
+	Offset int64
+}
+
+func (e *DuplicateAttributeError) Error() string {
+	return "element " + strconv.Quote(e.Element) + " at offset " + strconv.FormatInt(e.Offset, 10) +
+		" repeats attribute " + strconv.Quote(e.Attribute)
+}
+
+// SetDuplicateAttributePolicy configures how an attribute repeated on one element is handled - encoding/xml doesn't
+// reject such malformed input, but hands over every occurrence.  The policy applies wherever the reader itself looks
+// attributes up: Attributes, Attribute and the discriminator of DecodePolymorphic.  A repeat is an attribute with the
+// same full name (namespace and local name), so xml:lang and lang are distinct.  Elements decoded into structs by
+// encoding/xml aren't affected.
+func (r *Reader) SetDuplicateAttributePolicy(policy DuplicateAttributePolicy) {
+	r.duplicateAttrs = policy
+}
+
+// Attributes returns the element's attributes by their qualified names, per the duplicate attribute policy
+func (r *Reader) Attributes(se xml.StartElement) (map[QName]string, error) {
+	attrs := make(map[QName]string, len(se.Attr))
+	for _, attr := range se.Attr {
+		name := QName{Space: attr.Name.Space, Local: attr.Name.Local}
+		if _, seen := attrs[name]; seen {
+			switch r.duplicateAttrs {
+			case FirstDuplicateAttribute:
+				continue
+			case ErrorOnDuplicateAttribute:
+				return nil, r.duplicateAttributeError(se, name)
+			}
+		}
+		attrs[name] = attr.Value
+	}
+	return attrs, nil
+}
+
+// Attribute returns the value of the element's attribute with the given local name, in whichever namespace, and
+// whether it has one, per the duplicate attribute policy - when attributes in different namespaces share the local
+// name, the one that appears first is used
+func (r *Reader) Attribute(se xml.StartElement, local string) (string, bool, error) {
+	var name xml.Name
+	value, found := "", false
+	for _, attr := range se.Attr {
+		if attr.Name.Local != local || (found && attr.Name != name) {
+			continue
+		}
+
+		if found {
+			switch r.duplicateAttrs {
+			case FirstDuplicateAttribute:
+				return value, true, nil
+			case ErrorOnDuplicateAttribute:
+				return "", false, r.duplicateAttributeError(se, QName{Space: name.Space, Local: name.Local})
+			}
+		}
+		name, value, found = attr.Name, attr.Value, true
+	}
+	return value, found, nil
+}
+
+// duplicateAttributeError builds the error for the element repeating the attribute
+func (r *Reader) duplicateAttributeError(se xml.StartElement, name QName) error {
+	return &DuplicateAttributeError{Element: se.Name.Local, Attribute: name.String(), Offset: r.Offset()}
+}
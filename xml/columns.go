@@ -0,0 +1,115 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// defaultColumnBatchSize is how many records StreamColumns accumulates per batch, unless configured otherwise
+const defaultColumnBatchSize = 1024
+
+// Column describes one column of a columnar batch - Extract pulls the column's value out of each decoded record
+type Column struct {
+	Name    string
+	Extract func(e *Element) (interface{}, error)
+}
+
+// TextColumn is a Column holding the text of the named child element
+func TextColumn(name, child string) Column {
+	return Column{
+		Name: name,
+		Extract: func(e *Element) (interface{}, error) {
+			return e.ChildText(child), nil
+		},
+	}
+}
+
+// AttrColumn is a Column holding the value of the named attribute
+func AttrColumn(name, attr string) Column {
+	return Column{
+		Name: name,
+		Extract: func(e *Element) (interface{}, error) {
+			value, _ := e.Attr(attr)
+			return value, nil
+		},
+	}
+}
+
+// ColumnarBatch holds records in a columnar layout - Columns[i] holds the values of the column named Names[i], one per
+// record, for Len records
+type ColumnarBatch struct {
+	Names   []string
+	Columns [][]interface{}
+	Len     int
+}
+
+// SetColumnBatchSize sets how many records StreamColumns accumulates per batch (1024 by default)
+func (r *Reader) SetColumnBatchSize(n int) {
+	r.columnBatchSize = n
+}
+
+// StreamColumns bridges row-oriented XML into columnar sinks: each recordName element is decoded, the schema's columns
+// are extracted from it, and the values are accumulated into per-column slices, which are handed to onBatch whenever the
+// column batch size is reached (and once more at the end, for any remainder).  Each batch has its own slices, so onBatch
+// may retain them.
+func (r *Reader) StreamColumns(recordName string, schema []Column, onBatch func(ColumnarBatch) error) error {
+	size := r.columnBatchSize
+	if size <= 0 {
+		size = defaultColumnBatchSize
+	}
+
+	names := make([]string, len(schema))
+	for i, column := range schema {
+		names[i] = column.Name
+	}
+
+	newBatch := func() ColumnarBatch {
+		batch := ColumnarBatch{Names: names, Columns: make([][]interface{}, len(schema))}
+		for i := range batch.Columns {
+			batch.Columns[i] = make([]interface{}, 0, size)
+		}
+		return batch
+	}
+
+	batch := newBatch()
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != recordName {
+			continue
+		}
+
+		e := &Element{}
+		if err := r.decodeElement(e, &se); err != nil {
+			return err
+		}
+
+		for i, column := range schema {
+			value, err := column.Extract(e)
+			if err != nil {
+				return err
+			}
+			batch.Columns[i] = append(batch.Columns[i], value)
+		}
+		batch.Len++
+
+		if batch.Len >= size {
+			if err := onBatch(batch); err != nil {
+				return err
+			}
+			batch = newBatch()
+		}
+	}
+
+	if batch.Len > 0 {
+		return onBatch(batch)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package xml
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// maxEntityNameLength bounds how much of a potential entity reference the counter buffers
+const maxEntityNameLength = 64
+
+// ErrEntityLimitExceeded is returned when the input references custom entities more than the configured limits allow
+var ErrEntityLimitExceeded = errors.New("entity expansion limit exceeded")
+
+// SetEntities configures custom entities (beyond the predefined XML ones) for the decoder to expand, mapping entity names
+// to their replacement text.  It must be set before the first token is read.
+func (r *Reader) SetEntities(entities map[string]string) {
+	r.entities = entities
+}
+
+// SetMaxEntityExpansions caps how many custom entity references the input may contain, guarding against entity
+// expansion attacks - once exceeded, reading fails with ErrEntityLimitExceeded.  Zero (the default) means no limit.
+//
+// encoding/xml already protects against the classic attacks: it doesn't process DTDs (so documents can't declare
+// entities), never resolves external entities, and inserts the replacement text of custom entities literally rather
+// than re-parsing it, so expansion can't recurse (no "billion laughs").  What remains is amplification through a custom
+// entity map - a small document referencing a large replacement text many times - which this and SetMaxEntityBytes
+// bound.  References are counted in the raw input, so they're only counted accurately for ASCII-compatible encodings,
+// and references inside comments or CDATA sections count even though they aren't expanded.
+func (r *Reader) SetMaxEntityExpansions(n int) {
+	r.maxEntityExpansions = n
+}
+
+// SetMaxEntityBytes caps the total bytes produced by custom entity expansion - see SetMaxEntityExpansions.  Zero (the
+// default) means no limit.
+func (r *Reader) SetMaxEntityBytes(n int64) {
+	r.maxEntityBytes = n
+}
+
+// EntityExpansions returns how many custom entity references have been read so far, and how many bytes they expand to -
+// these are only tracked when a limit is set
+func (r *Reader) EntityExpansions() (count int, bytes int64) {
+	if r.entity == nil {
+		return 0, 0
+	}
+	return r.entity.expansions, r.entity.expandedBytes
+}
+
+// entityCounter watches the input for references to custom entities, failing once a limit is exceeded - it implements
+// io.ByteReader so encoding/xml reads it directly, without buffering ahead
+type entityCounter struct {
+	source        io.ByteReader
+	entities      map[string]string
+	maxExpansions int
+	maxBytes      int64
+	expansions    int
+	expandedBytes int64
+	inReference   bool
+	name          []byte
+}
+
+func newEntityCounter(source io.Reader, entities map[string]string, maxExpansions int, maxBytes int64) *entityCounter {
+	byteReader, ok := source.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(source)
+	}
+
+	return &entityCounter{
+		source:        byteReader,
+		entities:      entities,
+		maxExpansions: maxExpansions,
+		maxBytes:      maxBytes,
+	}
+}
+
+func (e *entityCounter) ReadByte() (byte, error) {
+	c, err := e.source.ReadByte()
+	if err != nil {
+		return c, err
+	}
+
+	switch {
+	case c == '&':
+		e.inReference = true
+		e.name = e.name[:0]
+	case !e.inReference:
+	case c == ';':
+		e.inReference = false
+		if value, ok := e.entities[string(e.name)]; ok {
+			e.expansions++
+			e.expandedBytes += int64(len(value))
+
+			if (e.maxExpansions > 0 && e.expansions > e.maxExpansions) || (e.maxBytes > 0 && e.expandedBytes > e.maxBytes) {
+				return 0, ErrEntityLimitExceeded
+			}
+		}
+	case isEntityNameByte(c) && len(e.name) < maxEntityNameLength:
+		e.name = append(e.name, c)
+	default:
+		e.inReference = false
+	}
+
+	return c, nil
+}
+
+func (e *entityCounter) Read(p []byte) (int, error) {
+	for i := range p {
+		c, err := e.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = c
+	}
+	return len(p), nil
+}
+
+// isEntityNameByte reports whether the byte may be part of an entity name (non-ASCII bytes are allowed through, as they
+// may be part of a multi-byte name character)
+func isEntityNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == ':' || c >= 0x80
+}
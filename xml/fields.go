@@ -0,0 +1,100 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// DecodeFields projects each elementName element down to the named fields, as strings, handing each row to onRow -
+// only the requested fields are extracted, and the rest of the element is skipped over without decoding it.  Fields are
+// addressed relative to the element: "name" is the text of a child element, "address/city" of a nested one, "@id" is
+// an attribute of the element itself, and "address/@kind" one of a nested element.  When an addressed element repeats,
+// the first one's value is used.  Fields that aren't present are left out of the row (so they can be told apart from
+// empty ones).
+func (r *Reader) DecodeFields(elementName string, fields []string, onRow func(map[string]string) error) error {
+	wanted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		wanted[field] = true
+	}
+
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		row, err := r.projectElement(se, wanted)
+		if err != nil {
+			return err
+		}
+		if err := onRow(row); err != nil {
+			return err
+		}
+	}
+}
+
+// projectElement reads the rest of the element whose start was just read, extracting the wanted fields
+func (r *Reader) projectElement(se xml.StartElement, wanted map[string]bool) (map[string]string, error) {
+	row := make(map[string]string)
+	for _, attr := range se.Attr {
+		if wanted["@"+attr.Name.Local] {
+			row["@"+attr.Name.Local] = attr.Value
+		}
+	}
+
+	// the path of each open element below this one, and whether its text is being captured
+	var paths []string
+	var capturing []bool
+	done := make(map[string]bool)
+
+	depth := r.depth
+	for {
+		t, err := r.token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := t.(type) {
+		case xml.StartElement:
+			path := tok.Name.Local
+			if len(paths) > 0 {
+				path = paths[len(paths)-1] + "/" + path
+			}
+			capture := wanted[path] && !done[path]
+			if capture {
+				row[path] = ""
+			}
+			paths = append(paths, path)
+			capturing = append(capturing, capture)
+
+			for _, attr := range tok.Attr {
+				key := path + "/@" + attr.Name.Local
+				if _, seen := row[key]; wanted[key] && !seen {
+					row[key] = attr.Value
+				}
+			}
+		case xml.CharData:
+			if len(capturing) > 0 && capturing[len(capturing)-1] {
+				path := paths[len(paths)-1]
+				row[path] += string(tok)
+			}
+		case xml.EndElement:
+			if r.depth < depth {
+				return row, nil
+			}
+			if capturing[len(capturing)-1] {
+				done[paths[len(paths)-1]] = true
+			}
+			paths = paths[:len(paths)-1]
+			capturing = capturing[:len(capturing)-1]
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// KeyStyle determines how DecodeToMap transforms element and attribute names into map keys
+type KeyStyle int
+
+const (
+	// PreserveKeys uses names as they appear in the document
+	PreserveKeys KeyStyle = iota
+
+	// LowerKeys lower-cases names, so "OrderID" becomes "orderid"
+	LowerKeys
+
+	// SnakeKeys converts names to snake_case, so "OrderID" becomes "order_id" and "ship-to" becomes "ship_to"
+	SnakeKeys
+)
+
+// DecodeToMap decodes each elementName element into a nested map, handing each one to onItem - for schema-less
+// ingestion, where the shape of the records isn't known up front.  Within the map, attributes are keyed by their name
+// prefixed with "@", and child elements by their name, so the two can't collide.  A child element with neither
+// attributes nor children of its own becomes its text, as a string; any other child becomes a nested map, holding its
+// text (if it has any that isn't whitespace) under "#text".  Repeated child elements become a []interface{} of their
+// values, in document order.  Names are transformed per keyStyle (after the "@" prefix, for attributes), and namespace
+// prefixes are dropped.
+func (r *Reader) DecodeToMap(elementName string, onItem func(map[string]interface{}) error, keyStyle KeyStyle) error {
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		item, err := r.mapElement(se, keyStyle)
+		if err != nil {
+			return err
+		}
+		if err := onItem(item); err != nil {
+			return err
+		}
+	}
+}
+
+// mapElement reads the rest of the element whose start was just read into a map
+func (r *Reader) mapElement(se xml.StartElement, keyStyle KeyStyle) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for _, attr := range se.Attr {
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+		m["@"+mapKey(attr.Name.Local, keyStyle)] = attr.Value
+	}
+
+	var text strings.Builder
+	depth := r.depth
+	for {
+		t, err := r.token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := t.(type) {
+		case xml.StartElement:
+			child, err := r.mapElement(tok, keyStyle)
+			if err != nil {
+				return nil, err
+			}
+			addMapValue(m, mapKey(tok.Name.Local, keyStyle), mapValue(child))
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if r.depth < depth {
+				if s := strings.TrimSpace(text.String()); s != "" || len(m) == 0 {
+					m["#text"] = text.String()
+				}
+				return m, nil
+			}
+		}
+	}
+}
+
+// mapValue collapses an element's map down to its text, when the element had nothing else
+func mapValue(m map[string]interface{}) interface{} {
+	if text, ok := m["#text"]; ok && len(m) == 1 {
+		return text
+	}
+	return m
+}
+
+// addMapValue sets the key in the map, turning it into a slice of values if the key was already set
+func addMapValue(m map[string]interface{}, key string, value interface{}) {
+	existing, ok := m[key]
+	if !ok {
+		m[key] = value
+		return
+	}
+
+	if values, ok := existing.([]interface{}); ok {
+		m[key] = append(values, value)
+		return
+	}
+	m[key] = []interface{}{existing, value}
+}
+
+// mapKey transforms a name into a map key per the key style
+func mapKey(name string, keyStyle KeyStyle) string {
+	switch keyStyle {
+	case LowerKeys:
+		return strings.ToLower(name)
+	case SnakeKeys:
+		return snakeCase(name)
+	}
+	return name
+}
+
+// snakeCase converts a name to snake_case, splitting words at case changes and separators ("-", "." and spaces)
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	for i, c := range runes {
+		if c == '-' || c == '.' || c == ' ' || c == '_' {
+			if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "_") {
+				sb.WriteRune('_')
+			}
+			continue
+		}
+
+		if unicode.IsUpper(c) && i > 0 && sb.Len() > 0 && !strings.HasSuffix(sb.String(), "_") {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sb.WriteRune('_')
+			}
+		}
+		sb.WriteRune(unicode.ToLower(c))
+	}
+	return strings.TrimSuffix(sb.String(), "_")
+}
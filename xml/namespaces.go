@@ -0,0 +1,80 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// DecodeWithNamespaces decodes each elementName element into a value from newFn, handing it to onItem along with the
+// namespace declarations in scope at the element (including its own) - for resolving QName-valued content, like
+// xsi:type="ns:Kind".  The map is from prefix to URI, with the default namespace under "", and is the caller's to keep.
+func (r *Reader) DecodeWithNamespaces(elementName string, newFn func() interface{}, onItem func(v interface{}, ns map[string]string) error) error {
+
+	// the declarations made by each open element enclosing the current position
+	var scopes []map[string]string
+
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tok := t.(type) {
+		case xml.StartElement:
+			declared := namespaceDeclarations(tok)
+			if tok.Name.Local != elementName {
+				scopes = append(scopes, declared)
+				continue
+			}
+
+			ns := make(map[string]string)
+			for _, scope := range scopes {
+				for prefix, uri := range scope {
+					ns[prefix] = uri
+				}
+			}
+			for prefix, uri := range declared {
+				ns[prefix] = uri
+			}
+
+			// decoding consumes the element, so it never opens a scope
+			v := newFn()
+			if err := r.DecodeToken(v, &tok); err != nil {
+				return err
+			}
+			if err := onItem(v, ns); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+		}
+	}
+}
+
+// namespaceDeclarations returns the namespace declarations made on the element, or nil if it makes none
+func namespaceDeclarations(se xml.StartElement) map[string]string {
+	var declared map[string]string
+	for _, attr := range se.Attr {
+		prefix, ok := "", false
+		switch {
+		case attr.Name.Space == "xmlns":
+			prefix, ok = attr.Name.Local, true
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			ok = true
+		}
+		if !ok {
+			continue
+		}
+
+		if declared == nil {
+			declared = make(map[string]string)
+		}
+		declared[prefix] = attr.Value
+	}
+	return declared
+}
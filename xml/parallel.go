@@ -0,0 +1,108 @@
+package xml
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// DecodeParallel decodes each elementName element and hands it to handler on one of workers goroutines, for when
+// handling records costs more than parsing them.  Decoding stays on the calling goroutine (the decoder isn't safe for
+// concurrent use), but targets are drawn from a pool of values made by newFn - which must return a pointer - and
+// recycled once the handler returns, so steady-state decoding allocates no targets.  Each target is zeroed before it's
+// reused, and must not be retained by the handler after it returns.  Handlers run concurrently and in no particular
+// order; the first error (from decoding or a handler) stops the read and is returned once in-flight handlers finish.
+func (r *Reader) DecodeParallel(elementName string, workers int, newFn func() interface{}, handler func(interface{}) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// a couple of targets per worker lets decoding run ahead of the handlers
+	free := make(chan interface{}, workers*2)
+	for i := 0; i < cap(free); i++ {
+		v := newFn()
+		if reflect.ValueOf(v).Kind() != reflect.Ptr {
+			return errors.New("parallel decode requires newFn to return a pointer")
+		}
+		free <- v
+	}
+
+	var (
+		once     sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	work := make(chan interface{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range work {
+				select {
+				case <-failed:
+				default:
+					if err := handler(v); err != nil {
+						fail(err)
+					}
+				}
+				free <- v
+			}
+		}()
+	}
+
+	r.decodeParallel(elementName, free, work, failed, fail)
+
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// decodeParallel feeds decoded targets to the workers until the input is exhausted or something fails
+func (r *Reader) decodeParallel(elementName string, free, work chan interface{}, failed chan struct{}, fail func(error)) {
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		// wait for a target to come free, which bounds how far decoding gets ahead
+		var v interface{}
+		select {
+		case v = <-free:
+		case <-failed:
+			return
+		}
+
+		target := reflect.ValueOf(v).Elem()
+		target.Set(reflect.Zero(target.Type()))
+		if err := r.DecodeToken(v, &se); err != nil {
+			fail(err)
+			return
+		}
+
+		select {
+		case work <- v:
+		case <-failed:
+			return
+		}
+	}
+}
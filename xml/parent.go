@@ -0,0 +1,115 @@
+package xml
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// parentFrame holds the keys captured from an open parent element
+type parentFrame struct {
+	name      string
+	depth     int
+	values    map[string]string
+	capturing string
+	captured  strings.Builder
+}
+
+// SetParentKeys denormalizes hierarchical documents into flat records - while inside a parentName element, every record
+// emitted through BuildRecordsFromToken carries the parent's keys in its Parent map, named "parentName.key" (e.g. each
+// <line> record tagged with its <order>'s id as "order.id").  Keys are taken from the parent's attributes, or from the
+// text of its child elements with that name.  Child elements are only seen when they pass through the token stream, so
+// they must appear before the records and not be decoded by the builder.  Call once per parent element to capture from
+// several levels of nesting.
+func (r *Reader) SetParentKeys(parentName string, keys ...string) {
+	if r.parentKeys == nil {
+		r.parentKeys = make(map[string][]string)
+	}
+	r.parentKeys[parentName] = keys
+}
+
+// startParent opens a frame when a configured parent element starts, or starts capturing a parent key's text
+func (r *Reader) startParent(se xml.StartElement) {
+	if len(r.parentKeys) == 0 {
+		return
+	}
+
+	if keys, ok := r.parentKeys[se.Name.Local]; ok {
+		frame := &parentFrame{
+			name:   se.Name.Local,
+			depth:  r.depth,
+			values: make(map[string]string),
+		}
+		for _, key := range keys {
+			for _, attr := range se.Attr {
+				if attr.Name.Local == key {
+					frame.values[frame.name+"."+key] = attr.Value
+				}
+			}
+		}
+		r.parents = append(r.parents, frame)
+		return
+	}
+
+	// a direct child of the innermost parent might be one of its keys
+	if len(r.parents) == 0 {
+		return
+	}
+	frame := r.parents[len(r.parents)-1]
+	if frame.depth != r.depth-1 {
+		return
+	}
+	for _, key := range r.parentKeys[frame.name] {
+		if key == se.Name.Local {
+			frame.capturing = key
+			frame.captured.Reset()
+		}
+	}
+}
+
+// captureParentText collects the text of a parent key element
+func (r *Reader) captureParentText(cd xml.CharData) {
+	if len(r.parents) == 0 {
+		return
+	}
+	frame := r.parents[len(r.parents)-1]
+	if frame.capturing != "" {
+		frame.captured.Write(cd)
+	}
+}
+
+// endParents closes frames for parent elements that have ended, and any key capture that has completed
+func (r *Reader) endParents() {
+	for len(r.parents) > 0 {
+		frame := r.parents[len(r.parents)-1]
+
+		if frame.capturing != "" && r.depth == frame.depth {
+			frame.values[frame.name+"."+frame.capturing] = strings.TrimSpace(frame.captured.String())
+			frame.capturing = ""
+		}
+
+		if frame.depth <= r.depth {
+			return
+		}
+		r.parents = r.parents[:len(r.parents)-1]
+	}
+}
+
+// attachParents gives each record without parent context a copy of the keys from every open parent
+func (r *Reader) attachParents(records []*Record) {
+	if len(r.parents) == 0 {
+		return
+	}
+
+	for _, record := range records {
+		if record == nil || record.Parent != nil {
+			continue
+		}
+
+		record.Parent = make(map[string]string)
+		for _, frame := range r.parents {
+			for k, v := range frame.values {
+				record.Parent[k] = v
+			}
+		}
+	}
+}
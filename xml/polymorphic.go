@@ -0,0 +1,67 @@
+package xml
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// RegisterType associates a discriminator value with a factory for the concrete type it decodes into, for use by
+// DecodePolymorphic
+func (r *Reader) RegisterType(discriminator string, newFn func() interface{}) {
+	if r.types == nil {
+		r.types = make(map[string]func() interface{})
+	}
+	r.types[discriminator] = newFn
+}
+
+// DecodePolymorphic decodes tagged unions, where the value of an attribute on each elementName element selects its
+// concrete type (e.g. <event type="click"> vs <event type="view">).  The factory registered for the discriminator with
+// RegisterType provides the value to decode into, which is handed to onItem as a record with the discriminator as its
+// TypeName.  An element with an unregistered (or missing) discriminator fails the read, or is skipped in tolerant mode.
+func (r *Reader) DecodePolymorphic(elementName, discriminatorAttr string, onItem func(*Record) error) error {
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		discriminator, _, err := r.Attribute(se, discriminatorAttr)
+		if err != nil {
+			return err
+		}
+
+		newFn, ok := r.types[discriminator]
+		if !ok {
+			if r.tolerant {
+				atomic.AddInt64(&r.skipped, 1)
+				if err := r.skipElement(); err != nil {
+					return err
+				}
+				continue
+			}
+			return errors.New("no type registered for " + strconv.Quote(elementName) + " with " + discriminatorAttr + "=" + strconv.Quote(discriminator))
+		}
+
+		v := newFn()
+		if err := r.DecodeToken(v, &se); err != nil {
+			return err
+		}
+
+		records := []*Record{{TypeName: discriminator, Data: v}}
+		r.attachParents(records)
+		if err := onItem(records[0]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package xml
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// QName is an element's fully-qualified name - its namespace URI (empty when it has none) and local name
+type QName struct {
+	Space string
+	Local string
+}
+
+// ParseQName parses a name in "{uri}local" form, or a bare local name for an element in no namespace
+func ParseQName(s string) QName {
+	if strings.HasPrefix(s, "{") {
+		if end := strings.Index(s, "}"); end > 0 {
+			return QName{Space: s[1:end], Local: s[end+1:]}
+		}
+	}
+	return QName{Local: s}
+}
+
+// String returns the name in "{uri}local" form (or just the local name, when it has no namespace)
+func (q QName) String() string {
+	if q.Space == "" {
+		return q.Local
+	}
+	return "{" + q.Space + "}" + q.Local
+}
+
+// Matches reports whether the name matches a pattern in "{uri}local" form - a bare local name only matches names in no
+// namespace, and "*" matches any local name, so "{uri}*" matches everything in the namespace
+func (q QName) Matches(pattern string) bool {
+	p := ParseQName(pattern)
+	return p.Space == q.Space && (p.Local == "*" || p.Local == q.Local)
+}
+
+// RecordsBuilderFunctionNS is a RecordsBuilderFunction that's also given the qualified name of element tokens
+type RecordsBuilderFunctionNS func(xml.Token, QName) RecordsBuilderResult
+
+// BuildRecordsFromTokenNS is BuildRecordsFromToken for builders that need to tell elements apart by namespace (like
+// a:item vs b:item) - along with each token, the builder gets its qualified name, with the namespace URI the prefix
+// resolves to.  The name is empty for tokens other than element starts and ends.
+func (r *Reader) BuildRecordsFromTokenNS(recordsBuilder RecordsBuilderFunctionNS) ProcessTokenResult {
+	return r.BuildRecordsFromToken(func(t xml.Token) RecordsBuilderResult {
+		return recordsBuilder(t, qnameOf(t))
+	})
+}
+
+// qnameOf returns the qualified name of an element token
+func qnameOf(t xml.Token) QName {
+	switch tok := t.(type) {
+	case xml.StartElement:
+		return QName{Space: tok.Name.Space, Local: tok.Name.Local}
+	case xml.EndElement:
+		return QName{Space: tok.Name.Space, Local: tok.Name.Local}
+	}
+	return QName{}
+}
@@ -0,0 +1,87 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// NewReaderAt creates a reader over random-access input of the given size.  It streams like any other reader, and is
+// always seekable, so it also supports DecodeElementAt for extracting specific elements without re-scanning (e.g. from
+// an index of element offsets built in a first pass).
+func NewReaderAt(ra io.ReaderAt, size int64) *Reader {
+	r := NewReader(io.NewSectionReader(ra, 0, size))
+	r.size = size
+	r.readerAt = ra
+	return r
+}
+
+// DecodeElementAt decodes the single element starting at offset into v, using a fresh decoder anchored at the offset.
+// The offset must be the exact byte offset of the element's opening '<' (optionally preceded by whitespace).  Since the
+// decoder starts mid-document, it doesn't see the document's XML declaration or namespace declarations made by
+// enclosing elements - the input at offset is treated as UTF-8, and prefixes declared by ancestors are left unresolved.
+// This doesn't affect the streaming position of the reader.  The input must be seekable (see Seekable), or
+// ErrNotSeekable is returned.
+func (r *Reader) DecodeElementAt(offset int64, v interface{}) error {
+	ra, size, err := r.randomAccess()
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset >= size {
+		return errors.New("offset " + strconv.FormatInt(offset, 10) + " is outside the input")
+	}
+
+	sub := r.derive(io.NewSectionReader(ra, offset, size-offset), size-offset)
+	for {
+		t, err := sub.token()
+		if err == io.EOF {
+			return errors.New("no element found at offset " + strconv.FormatInt(offset, 10))
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tok := t.(type) {
+		case xml.StartElement:
+			return sub.DecodeToken(v, &tok)
+		case xml.CharData:
+			if len(bytes.TrimSpace(tok)) == 0 {
+				continue
+			}
+		}
+
+		return errors.New("offset " + strconv.FormatInt(offset, 10) + " does not point at an element")
+	}
+}
+
+// BuildIndex scans the input once, returning the byte offset of every elementName element (other than those nested
+// within another), in the form DecodeElementAt accepts - persist it to fetch specific elements later without
+// re-scanning.  Element bodies are skipped rather than decoded.  Offsets are positions in the input as the decoder sees
+// it, so they only line up with the underlying bytes for UTF-8 input that the reader doesn't rewrite (no forced
+// encoding or UTF-8 sanitizing), and only for a single file (not across rotation).
+func (r *Reader) BuildIndex(elementName string) ([]int64, error) {
+	var offsets []int64
+	for {
+		// between tokens, the offset is the start of the next one
+		offset := r.Offset()
+		t, err := r.token()
+		if err == io.EOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		offsets = append(offsets, offset)
+		if err := r.skipElement(); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+// RawXML holds an element's inner markup verbatim, for deferring (or skipping) parsing of its content - a record's Data
+// can hold it until the record turns out to be worth parsing in full
+type RawXML []byte
+
+// Unmarshal decodes the raw content into v, as if it were the body of an element - v shouldn't require a particular
+// element name.  Namespace prefixes declared outside of the captured content are left unresolved.
+func (raw RawXML) Unmarshal(v interface{}) error {
+	wrapped := make([]byte, 0, len(raw)+len("<raw></raw>"))
+	wrapped = append(wrapped, "<raw>"...)
+	wrapped = append(wrapped, raw...)
+	wrapped = append(wrapped, "</raw>"...)
+	return xml.Unmarshal(wrapped, v)
+}
+
+// DecodeRaw captures the inner markup of the element whose start was just read, consuming the element.  Capturing
+// works from the token stream itself, so the input needn't be seekable.  Usually the markup is captured byte-for-byte;
+// when a text transform is set, the transformed tokens are re-encoded instead, which keeps the content equivalent but
+// not necessarily identical (e.g. namespace declarations and quoting may differ).
+func (r *Reader) DecodeRaw(start *xml.StartElement) (RawXML, error) {
+	if r.textTransform == nil {
+		var inner struct {
+			Content []byte `xml:",innerxml"`
+		}
+		if err := r.decodeElement(&inner, start); err != nil {
+			return nil, err
+		}
+		return RawXML(inner.Content), nil
+	}
+
+	// the transformed token stream has no raw bytes behind it, so re-encode its tokens
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	depth := r.depth
+	for {
+		t, err := r.token()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := t.(xml.EndElement); ok && r.depth < depth {
+			break
+		}
+		if err := encoder.EncodeToken(xml.CopyToken(t)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return RawXML(buf.Bytes()), nil
+}
@@ -2,20 +2,118 @@ package xml
 
 import (
 	"encoding/xml"
+	"errors"
 	"golang.org/x/net/html/charset"
 	"io"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // converts a file to records ((data, error) tuples)
 type Reader struct {
-	xmlFile *os.File
-	decoder *xml.Decoder
+	readerOptions
+	xmlFile  *os.File
+	source   io.Reader
+	readerAt io.ReaderAt
+	size     int64
+	decoder  *xml.Decoder
+	raw      *xml.Decoder
+	entity   *entityCounter
+	err      error
+
+	// updated atomically, as an abandoned decode (see SetDecodeTimeout) may still be skipping text
+	skipped int64
+
+	// set once a decode has timed out, after which the decoder belongs to the abandoned decode - Offset reports where
+	// that decode started instead of reading the decoder
+	abandoned       bool
+	abandonedOffset int64
+
+	// supplies the next file once the current one is exhausted
+	rotationSource func() (string, bool)
+
+	// element nesting, as seen through the token stream (and elements decoded from it)
+	depth       int
+	parents     []*parentFrame
+	rootEmitted bool
+	roots       int
+
+	// set while reading a stream of messages, which has a root per message
+	messageStream bool
+
+	// records built so far by type, for the summary
+	recordCounts   map[string]int
+	summaryEmitted bool
+}
+
+// readerOptions holds the configuration of a reader, which carries over to readers derived from it
+type readerOptions struct {
+	decodeTimeout time.Duration
+	utf8Policy    UTF8Policy
+	tagPreference []string
+	forceEncoding string
+
+	// custom entities, and limits on their expansion
+	entities            map[string]string
+	maxEntityExpansions int
+	maxEntityBytes      int64
+
+	// parent element name -> attributes/child elements to capture onto child records
+	parentKeys map[string][]string
+
+	textTransform func(elementName, text string) (string, error)
+	tolerant      bool
+	emitRoot      bool
+	emitSummary   bool
+	multiRoot     bool
+	singleRoot    bool
+
+	columnBatchSize int
+
+	// discriminator -> factory, for polymorphic decoding
+	types map[string]func() interface{}
+
+	// element name -> attributes it must have
+	requiredAttrs map[string][]string
+
+	duplicateAttrs DuplicateAttributePolicy
+}
+
+// NewReader creates a reader over an arbitrary stream of XML - the caller remains responsible for closing src
+func NewReader(src io.Reader) *Reader {
+	return &Reader{
+		source: src,
+		size:   -1,
+	}
+}
+
+// derive creates a reader over src with the same options as this one
+func (r *Reader) derive(src io.Reader, size int64) *Reader {
+	sub := NewReader(src)
+	sub.readerOptions = r.readerOptions
+	sub.size = size
+	return sub
+}
+
+// DecodeTimeoutError is returned when decoding a single element takes longer than the configured decode timeout - Element
+// is empty when the decode wasn't given the element's start, as the decoder finds it itself
+type DecodeTimeoutError struct {
+	Element string
+	Timeout time.Duration
+}
+
+func (e *DecodeTimeoutError) Error() string {
+	return "decoding element " + strconv.Quote(e.Element) + " exceeded timeout of " + e.Timeout.String()
 }
 
 type Record struct {
 	TypeName string
 	Data     interface{}
+
+	// Parent holds keys captured from enclosing elements (see SetParentKeys), named "element.key"
+	Parent map[string]string
 }
 
 type RecordsBuilderResult struct {
@@ -27,6 +125,9 @@ type ProcessTokenResult struct {
 	Records       []*Record
 	IsEndOfStream bool
 	Err           error
+
+	// Offset is the decoder's input offset just after the token was read, anchoring the records to a source position
+	Offset int64
 }
 
 type RecordsBuilderFunction func(xml.Token) RecordsBuilderResult
@@ -52,12 +153,105 @@ func (r *Reader) Open(filename string) error {
 		return err
 	}
 
-	r.decoder = xml.NewDecoder(r.xmlFile)
-	r.decoder.CharsetReader = charset.NewReaderLabel
+	r.size = -1
+	if info, err := r.xmlFile.Stat(); err == nil {
+		r.size = info.Size()
+	}
 
+	r.source = r.xmlFile
+	r.resetState()
 	return nil
 }
 
+// resetState discards the decoder and everything tracked from the token stream, for starting over on new input
+func (r *Reader) resetState() {
+
+	// the decoder is built on first use, so options set after Open still apply
+	r.decoder = nil
+	r.raw = nil
+	r.err = nil
+	r.abandoned = false
+	r.depth = 0
+	r.parents = nil
+	r.rootEmitted = false
+	r.roots = 0
+}
+
+// getDecoder returns the decoder for the current source, building it if needed
+func (r *Reader) getDecoder() *xml.Decoder {
+	if r.decoder == nil {
+		r.decoder = r.newDecoder(r.source)
+	}
+	return r.decoder
+}
+
+// newDecoder builds a decoder over the given input, applying the reader's input-level options
+func (r *Reader) newDecoder(input io.Reader) *xml.Decoder {
+
+	// a forced encoding is converted to UTF-8 before anything else sees the input
+	if r.forceEncoding != "" {
+		converted, err := charset.NewReaderLabel(r.forceEncoding, input)
+		if err != nil {
+			r.err = err
+		} else {
+			input = converted
+		}
+	}
+
+	var validator *utf8Reader
+	if r.utf8Policy != UTF8Pass {
+		validator = newUTF8Reader(input, r.utf8Policy)
+		input = validator
+	}
+
+	r.entity = nil
+	if len(r.entities) > 0 && (r.maxEntityExpansions > 0 || r.maxEntityBytes > 0) {
+		r.entity = newEntityCounter(input, r.entities, r.maxEntityExpansions, r.maxEntityBytes)
+		input = r.entity
+	}
+
+	decoder := xml.NewDecoder(input)
+	decoder.Entity = r.entities
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+
+		// the input was already converted, whatever the document declares
+		if r.forceEncoding != "" {
+			return input, nil
+		}
+
+		// the document declared a non-UTF-8 encoding, so the raw bytes can't be validated as UTF-8 - the charset
+		// reader always produces valid UTF-8 anyway
+		if validator != nil {
+			validator.active = false
+		}
+		return charset.NewReaderLabel(label, input)
+	}
+	r.raw = decoder
+
+	// transforming text requires a token-level layer over the raw decoder
+	if r.textTransform != nil {
+		return xml.NewTokenDecoder(&textTransformer{source: decoder, reader: r})
+	}
+	return decoder
+}
+
+// Progress returns how many bytes of input the decoder has consumed, along with the total size of the input (the file
+// size for file readers, or -1 when unknown), for computing an ETA
+func (r *Reader) Progress() (bytesRead, totalBytes int64) {
+	return r.Offset(), r.size
+}
+
+// Offset returns the decoder's current input offset - the number of bytes of input consumed so far
+func (r *Reader) Offset() int64 {
+	if r.abandoned {
+		return r.abandonedOffset
+	}
+	if r.raw == nil {
+		return 0
+	}
+	return r.raw.InputOffset()
+}
+
 func (r *Reader) Close() error {
 	if r.xmlFile != nil {
 		return r.xmlFile.Close()
@@ -65,29 +259,226 @@ func (r *Reader) Close() error {
 	return nil
 }
 
+// SetForceEncoding makes the reader decode its input as the named encoding (any label the charset package knows, like
+// "utf-16le"), regardless of the document's declaration or byte order mark - an escape hatch for producers that emit,
+// say, UTF-16 without a BOM under a UTF-8 declaration.  It's a deliberate override, not a hint: nothing is sniffed, so
+// naming the wrong encoding produces garbage.  An unknown label fails the read.  It must be set before the first token
+// is read.
+func (r *Reader) SetForceEncoding(enc string) {
+	r.forceEncoding = enc
+}
+
+// SetDecodeTimeout bounds how long DecodeToken may spend on a single element - zero (the default) disables the
+// timeout.  Go can't interrupt a decode in progress, so on timeout the decode is abandoned in its goroutine, which keeps
+// reading from the underlying decoder until the element ends (or the input fails).  As a result, the value passed to
+// DecodeToken must not be used after a timeout, and the reader is unusable from then on - every subsequent call returns
+// the same *DecodeTimeoutError, and Offset stays at where the timed-out element's decode began.  This holds in tolerant
+// mode too: the timed-out element can't be skipped, as the abandoned decode still owns the decoder, so there's no
+// position to resume reading from.
+func (r *Reader) SetDecodeTimeout(d time.Duration) {
+	r.decodeTimeout = d
+}
+
 func (r *Reader) BuildRecordsFromToken(recordsBuilder RecordsBuilderFunction) ProcessTokenResult {
 
 	// decode a token
-	t, err := r.decoder.Token()
+	t, err := r.token()
+	offset := r.Offset()
 
 	// return an error, if one happened
 	if err != nil {
 		if err == io.EOF {
-			return ProcessTokenResult{nil, true, nil}
+			return ProcessTokenResult{Records: r.summaryRecords(), IsEndOfStream: true, Offset: offset}
 		}
 
-		return ProcessTokenResult{nil, false, err}
+		return ProcessTokenResult{Err: err, Offset: offset}
 	}
 
 	// stop looping when we have no more tokens
 	if t == nil {
-		return ProcessTokenResult{nil, true, nil}
+		return ProcessTokenResult{Records: r.summaryRecords(), IsEndOfStream: true, Offset: offset}
 	}
 
+	root := r.rootRecord(t)
+
 	res := recordsBuilder(t)
-	return ProcessTokenResult{res.Records, false, res.Err}
+	r.attachParents(res.Records)
+	r.countRecords(res.Records)
+	if root != nil {
+		res.Records = append([]*Record{root}, res.Records...)
+	}
+	return ProcessTokenResult{Records: res.Records, Err: res.Err, Offset: offset}
+}
+
+// token reads the next token from the decoder
+func (r *Reader) token() (xml.Token, error) {
+	for {
+		decoder := r.getDecoder()
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		t, err := decoder.Token()
+		if err == nil {
+			r.track(t)
+			if err = r.checkRoots(t); err != nil {
+				r.err = err
+				return nil, err
+			}
+
+			if err = r.checkRequired(t); err != nil {
+				if !r.tolerant {
+					return nil, err
+				}
+
+				// tolerant mode drops the whole element
+				atomic.AddInt64(&r.skipped, 1)
+				if err := r.skipElement(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		// when the current file is exhausted, continue with the next one, if there is one
+		if err == io.EOF && r.rotationSource != nil {
+			if next, ok := r.rotationSource(); ok {
+				if err := r.Close(); err != nil {
+					return nil, err
+				}
+				if err := r.Open(next); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		return t, err
+	}
+}
+
+// track follows element nesting through the token stream
+func (r *Reader) track(t xml.Token) {
+	switch tok := t.(type) {
+	case xml.StartElement:
+		r.depth++
+		r.startParent(tok)
+	case xml.EndElement:
+		r.endElement()
+	case xml.CharData:
+		r.captureParentText(tok)
+	}
+}
+
+// checkRoots fails a second top-level element, if SetMultiRoot(false) asked for a single root
+func (r *Reader) checkRoots(t xml.Token) error {
+	se, ok := t.(xml.StartElement)
+	if !ok || r.depth != 1 {
+		return nil
+	}
+
+	r.roots++
+	if r.roots > 1 && r.singleRoot && !r.messageStream {
+		return errors.New("unexpected second root element " + strconv.Quote(se.Name.Local) + " at offset " + strconv.FormatInt(r.Offset(), 10) + " (see SetMultiRoot)")
+	}
+	return nil
+}
+
+// SetMultiRoot makes the reader accept documents with several top-level elements (like concatenated log dumps),
+// treating each as a root of its own.  It's off by default because such a document isn't well-formed XML - but, like
+// encoding/xml, the reader doesn't check for a single root unless asked to: SetMultiRoot(false) makes a second root fail
+// the read.
+func (r *Reader) SetMultiRoot(multiRoot bool) {
+	r.multiRoot = multiRoot
+	r.singleRoot = !multiRoot
+}
+
+// endElement notes that the innermost open element has ended
+func (r *Reader) endElement() {
+	r.depth--
+	r.endParents()
+}
+
+// SetTolerant makes the reader skip problem content where it can (e.g. text that fails the text transform) rather than
+// failing - the number of skips is available from Skipped.  A decode timeout (see SetDecodeTimeout) can't be skipped,
+// so it fails the reader even in tolerant mode.
+func (r *Reader) SetTolerant(tolerant bool) {
+	r.tolerant = tolerant
+}
+
+// Skipped returns how many times content was skipped in tolerant mode
+func (r *Reader) Skipped() int {
+	return int(atomic.LoadInt64(&r.skipped))
+}
+
+// SetRotationSource supports tailing files that an upstream process rotates - when the current file is exhausted, next
+// is asked for the name of the following file, and if it provides one, the reader opens it and continues the token
+// stream.  A fresh decoder is created for each file, so element boundaries must align with file boundaries.
+func (r *Reader) SetRotationSource(next func() (string, bool)) {
+	r.rotationSource = next
 }
 
 func (r *Reader) DecodeToken(v interface{}, start *xml.StartElement) error {
-	return r.decoder.DecodeElement(v, start)
+	if !r.usesTagPreference() {
+		return r.decodeElement(v, start)
+	}
+
+	// decode generically, then map onto the struct using the preferred tags
+	n := &Element{}
+	if err := r.decodeElement(n, start); err != nil {
+		return err
+	}
+	return assignNode(v, n, r.tagPreference)
+}
+
+// skipElement discards the rest of the element whose start was just read, including its end
+func (r *Reader) skipElement() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	defer r.endElement()
+	return r.getDecoder().Skip()
+}
+
+// decodeElement decodes the element into v, enforcing the decode timeout if one is set
+func (r *Reader) decodeElement(v interface{}, start *xml.StartElement) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	// decoding consumes the rest of the element, including its end - without a start, the decoder reads the start tag
+	// itself, so the element was never tracked as open
+	if start != nil {
+		defer r.endElement()
+	}
+
+	if r.decodeTimeout <= 0 {
+		return r.getDecoder().DecodeElement(v, start)
+	}
+
+	// decode in the background so we can give up on it if it takes too long
+	done := make(chan error, 1)
+	decoder := r.getDecoder()
+	offset := r.Offset()
+	go func() {
+		done <- decoder.DecodeElement(v, start)
+	}()
+
+	timer := time.NewTimer(r.decodeTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		timeoutErr := &DecodeTimeoutError{Timeout: r.decodeTimeout}
+		if start != nil {
+			timeoutErr.Element = start.Name.Local
+		}
+		r.err = timeoutErr
+		r.abandoned = true
+		r.abandonedOffset = offset
+		return r.err
+	}
 }
@@ -0,0 +1,1271 @@
+package xml
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// openString writes the content to a temp file and opens a reader on it
+func openString(t *testing.T, content string) *Reader {
+	f, err := ioutil.TempFile("", "reader_test_*.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Reader{}
+	if err := r.Open(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = os.Remove(f.Name())
+	})
+	return r
+}
+
+// readText returns the text of every character data token in the document
+func readText(r *Reader) (string, error) {
+	text := ""
+	for {
+		res := r.BuildRecordsFromToken(func(t xml.Token) RecordsBuilderResult {
+			if cd, ok := t.(xml.CharData); ok {
+				text += string(cd)
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			return text, res.Err
+		}
+		if res.IsEndOfStream {
+			return text, nil
+		}
+	}
+}
+
+func TestReader_SetUTF8Policy(t *testing.T) {
+	r := openString(t, "<a>b\xffc</a>")
+	r.SetUTF8Policy(UTF8Sanitize)
+	text, err := readText(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "b�c" {
+		t.Fatal("invalid byte was not replaced: " + text)
+	}
+
+	r = openString(t, "<a>b\xffc</a>")
+	r.SetUTF8Policy(UTF8Reject)
+	_, err = readText(r)
+	if utf8Err, ok := err.(*UTF8Error); !ok || utf8Err.Offset != 4 {
+		t.Fatal("expected a UTF8Error at offset 4")
+	}
+
+	// non-UTF-8 documents are converted by the charset reader rather than sanitized
+	r = openString(t, "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><a>\xe9</a>")
+	r.SetUTF8Policy(UTF8Sanitize)
+	if text, err = readText(r); err != nil {
+		t.Fatal(err)
+	}
+	if text != "é" {
+		t.Fatal("latin-1 text was not decoded: " + text)
+	}
+}
+
+func TestReader_SetTagPreference(t *testing.T) {
+	type line struct {
+		Sku string `json:"sku"`
+		Qty int    `json:"qty"`
+	}
+	type order struct {
+		Id    string `json:"id"`
+		Total float64
+		Lines []line `json:"line"`
+	}
+
+	r := openString(t, `<order id="7"><total>9.5</total><line><sku>a</sku><qty>2</qty></line><line><sku>b</sku></line></order>`)
+	r.SetTagPreference([]string{"xml", "json"})
+
+	o := order{}
+	res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+		start := tok.(xml.StartElement)
+		return RecordsBuilderResult{Err: r.DecodeToken(&o, &start)}
+	})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	if o.Id != "7" || o.Total != 9.5 || len(o.Lines) != 2 || o.Lines[0].Qty != 2 || o.Lines[1].Sku != "b" {
+		t.Fatalf("unexpected decode result: %+v", o)
+	}
+}
+
+func TestReader_Progress(t *testing.T) {
+	content := "<a><b/></a>"
+	r := openString(t, content)
+
+	if read, total := r.Progress(); read != 0 || total != int64(len(content)) {
+		t.Fatal("unexpected progress before reading")
+	}
+	if _, err := readText(r); err != nil {
+		t.Fatal(err)
+	}
+	if read, _ := r.Progress(); read != int64(len(content)) {
+		t.Fatal("progress did not reach the end of the input")
+	}
+}
+
+func TestReader_SplitDocuments(t *testing.T) {
+	r := NewReader(strings.NewReader("<?xml version=\"1.0\"?>\n<a>1</a>\n---\n<?xml version=\"1.0\"?>\n<a>2</a>\n---\n"))
+
+	var texts []string
+	err := r.SplitDocuments(SeparatorSplit("---"), func(doc *Reader) error {
+		text, err := readText(doc)
+		texts = append(texts, strings.TrimSpace(text))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(texts) != 2 || texts[0] != "1" || texts[1] != "2" {
+		t.Fatalf("unexpected documents: %v", texts)
+	}
+}
+
+func TestReader_DecodeHeaderThenStream(t *testing.T) {
+	type header struct {
+		Generated string `xml:"generated"`
+	}
+	type item struct {
+		Id int `xml:"id,attr"`
+	}
+
+	r := NewReader(strings.NewReader(`<feed><header><generated>today</generated></header><item id="1"/><item id="2"/></feed>`))
+	h := header{}
+	sum := 0
+	err := r.DecodeHeaderThenStream("header", &h, "item", func() interface{} {
+		return &item{}
+	}, func(v interface{}) error {
+		sum += v.(*item).Id
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Generated != "today" || sum != 3 {
+		t.Fatal("header or records were not decoded")
+	}
+
+	r = NewReader(strings.NewReader(`<feed><item id="1"/><header/></feed>`))
+	err = r.DecodeHeaderThenStream("header", &h, "item", func() interface{} {
+		return &item{}
+	}, func(v interface{}) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected an error for a record before the header")
+	}
+}
+
+func TestReader_SetMaxEntityExpansions(t *testing.T) {
+	r := NewReader(strings.NewReader("<a>&big;&big;&amp;&big;</a>"))
+	r.SetEntities(map[string]string{"big": "0123456789"})
+	r.SetMaxEntityExpansions(2)
+
+	if _, err := readText(r); err != ErrEntityLimitExceeded {
+		t.Fatal("expected the entity limit to be exceeded")
+	}
+
+	r = NewReader(strings.NewReader("<a>&big;&big;</a>"))
+	r.SetEntities(map[string]string{"big": "0123456789"})
+	r.SetMaxEntityBytes(20)
+
+	text, err := readText(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "01234567890123456789" {
+		t.Fatal("entities were not expanded: " + text)
+	}
+	if count, bytes := r.EntityExpansions(); count != 2 || bytes != 20 {
+		t.Fatal("unexpected expansion counts")
+	}
+}
+
+func TestReader_SetRotationSource(t *testing.T) {
+	r := openString(t, "<a>1</a>")
+	next := openString(t, "<a>2</a>")
+	nextName := next.xmlFile.Name()
+
+	rotated := false
+	r.SetRotationSource(func() (string, bool) {
+		if rotated {
+			return "", false
+		}
+		rotated = true
+		return nextName, true
+	})
+
+	text, err := readText(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "12" {
+		t.Fatal("reader did not continue into the rotated file: " + text)
+	}
+}
+
+func TestReader_SetParentKeys(t *testing.T) {
+	type line struct {
+		Sku string `xml:"sku,attr"`
+	}
+
+	r := NewReader(strings.NewReader(`<orders><order id="1"><customer>c1</customer><line sku="a"/><line sku="b"/></order><order id="2"><line sku="c"/></order></orders>`))
+	r.SetParentKeys("order", "id", "customer")
+
+	var records []*Record
+	for {
+		res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "line" {
+				l := line{}
+				if err := r.DecodeToken(&l, &se); err != nil {
+					return RecordsBuilderResult{Err: err}
+				}
+				return RecordsBuilderResult{Records: []*Record{{TypeName: "line", Data: l}}}
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		records = append(records, res.Records...)
+		if res.IsEndOfStream {
+			break
+		}
+	}
+
+	if len(records) != 3 {
+		t.Fatal("expected 3 records")
+	}
+	if records[1].Parent["order.id"] != "1" || records[1].Parent["order.customer"] != "c1" {
+		t.Fatalf("unexpected parent context: %v", records[1].Parent)
+	}
+	if records[2].Parent["order.id"] != "2" || records[2].Parent["order.customer"] != "" {
+		t.Fatalf("unexpected parent context: %v", records[2].Parent)
+	}
+}
+
+func TestReader_DecodeEach(t *testing.T) {
+	type item struct {
+		Id int `xml:"id,attr"`
+	}
+
+	r := NewReader(strings.NewReader(`<items><item id="1"/><other/><item id="2"/></items>`))
+	target := item{}
+	sum := 0
+	err := r.DecodeEach("item", &target, func() error {
+		sum += target.Id
+		target = item{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatal("expected both items to be decoded")
+	}
+}
+
+func TestReader_SetTextTransform(t *testing.T) {
+	type item struct {
+		Payload string `xml:"payload"`
+	}
+
+	r := NewReader(strings.NewReader(`<items><item><payload>aGVsbG8=</payload></item><item><payload>!</payload></item></items>`))
+	r.SetTextTransform(func(elementName, text string) (string, error) {
+		if elementName != "payload" {
+			return text, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		return string(decoded), err
+	})
+
+	var payloads []string
+	target := item{}
+	err := r.DecodeEach("item", &target, func() error {
+		payloads = append(payloads, target.Payload)
+		target = item{}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the invalid payload to fail")
+	}
+	if len(payloads) != 1 || payloads[0] != "hello" {
+		t.Fatal("text was not transformed")
+	}
+
+	r = NewReader(strings.NewReader(`<items><item><payload>!</payload></item></items>`))
+	r.SetTextTransform(func(elementName, text string) (string, error) {
+		return "", errors.New("failed")
+	})
+	r.SetTolerant(true)
+	if _, err := readText(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Skipped() != 1 {
+		t.Fatal("expected the text node to be skipped")
+	}
+}
+
+func TestReader_DecodeElementAt(t *testing.T) {
+	type item struct {
+		Id int `xml:"id,attr"`
+	}
+
+	content := `<items><item id="1"/><item id="2"/></items>`
+	r := NewReaderAt(strings.NewReader(content), int64(len(content)))
+
+	i := item{}
+	if err := r.DecodeElementAt(int64(strings.Index(content, `<item id="2"`)), &i); err != nil {
+		t.Fatal(err)
+	}
+	if i.Id != 2 {
+		t.Fatal("decoded the wrong element")
+	}
+
+	if err := r.DecodeElementAt(3, &i); err == nil {
+		t.Fatal("expected an error for an offset inside a tag")
+	}
+}
+
+func TestReader_DecodeToken_NilStart(t *testing.T) {
+	r := NewReader(strings.NewReader(`<root><a/><b><c/></b></root>`))
+
+	// reads the root's start
+	if res := r.BuildRecordsFromToken(func(xml.Token) RecordsBuilderResult { return RecordsBuilderResult{} }); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// the decoder finds the next element itself, which leaves the tracked nesting as it was
+	var a struct {
+		XMLName xml.Name
+	}
+	if err := r.DecodeToken(&a, nil); err != nil || a.XMLName.Local != "a" {
+		t.Fatal("expected a to be decoded, got", a.XMLName, err)
+	}
+
+	var names []string
+	for {
+		res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+			if se, ok := tok.(xml.StartElement); ok {
+				names = append(names, se.Name.Local)
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.IsEndOfStream {
+			break
+		}
+	}
+	if strings.Join(names, ",") != "b,c" {
+		t.Fatal("expected the rest of the root to be read, got", names)
+	}
+}
+
+func TestReader_SetDecodeTimeout(t *testing.T) {
+	type item struct {
+		Name string `xml:"name"`
+	}
+
+	// the input stalls part-way through the element, so decoding can't finish
+	stalled := func() (*Reader, *io.PipeWriter) {
+		pr, pw := io.Pipe()
+		go pw.Write([]byte("<items><name>"))
+		r := NewReader(pr)
+		r.SetDecodeTimeout(10 * time.Millisecond)
+		return r, pw
+	}
+
+	r, pw := stalled()
+	defer pw.Close()
+	var timeoutErr *DecodeTimeoutError
+	if err := r.DecodeToken(&item{}, nil); !errors.As(err, &timeoutErr) || timeoutErr.Element != "" {
+		t.Fatal("expected a timeout without an element name, got", err)
+	}
+
+	r, pw = stalled()
+	defer pw.Close()
+	tok, err := r.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := tok.(xml.StartElement)
+	if err := r.DecodeToken(&item{}, &se); !errors.As(err, &timeoutErr) || timeoutErr.Element != "items" {
+		t.Fatal("expected a timeout naming the element, got", err)
+	}
+
+	// tolerant mode can't skip a timed-out element, and the abandoned decode may keep skipping text in the background
+	// while the reader is inspected
+	r, pw = stalled()
+	r.SetTolerant(true)
+	r.SetTextTransform(func(elementName, text string) (string, error) {
+		if text == "bad" {
+			return "", errors.New("bad text")
+		}
+		return text, nil
+	})
+	if err := r.DecodeToken(&item{}, nil); !errors.As(err, &timeoutErr) {
+		t.Fatal("expected the timeout to fail the tolerant reader, got", err)
+	}
+	go func() {
+		pw.Write([]byte("bad</name></items>"))
+		pw.Close()
+	}()
+	deadline := time.Now().Add(time.Second)
+	for r.Skipped() == 0 && time.Now().Before(deadline) {
+		r.Offset()
+		time.Sleep(time.Millisecond)
+	}
+	if r.Skipped() != 1 {
+		t.Fatal("expected the abandoned decode to skip the bad text, got", r.Skipped())
+	}
+}
+
+func TestReader_Seekable(t *testing.T) {
+	type item struct {
+		Id int `xml:"id,attr"`
+	}
+
+	content := `<items><item id="1"/><item id="2"/></items>`
+
+	// a plain strings.Reader can be seeked, so random access works without NewReaderAt
+	r := NewReader(strings.NewReader(content))
+	if !r.Seekable() {
+		t.Fatal("expected a strings.Reader to be seekable")
+	}
+	i := item{}
+	if err := r.DecodeElementAt(int64(strings.Index(content, `<item id="2"`)), &i); err != nil || i.Id != 2 {
+		t.Fatal("expected the second item to be decoded, got", i, err)
+	}
+	if err := r.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an io.ReadSeeker alone is enough, and random access leaves the stream where it was
+	r = NewReader(struct{ io.ReadSeeker }{strings.NewReader(content)})
+	if !r.Seekable() {
+		t.Fatal("expected an io.ReadSeeker to be seekable")
+	}
+	if _, err := r.token(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DecodeElementAt(int64(strings.Index(content, `<item id="2"`)), &i); err != nil || i.Id != 2 {
+		t.Fatal("expected the second item to be decoded, got", i, err)
+	}
+	if tok, err := r.token(); err != nil || tok.(xml.StartElement).Attr[0].Value != "1" {
+		t.Fatal("expected the stream to continue with the first item, got", tok, err)
+	}
+	if err := r.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// anything else fails cleanly
+	r = NewReader(ioutil.NopCloser(strings.NewReader(content)))
+	if r.Seekable() {
+		t.Fatal("expected a plain io.Reader not to be seekable")
+	}
+	if err := r.DecodeElementAt(0, &i); err != ErrNotSeekable {
+		t.Fatal("expected ErrNotSeekable, got", err)
+	}
+	if err := r.Reset(); err != ErrNotSeekable {
+		t.Fatal("expected ErrNotSeekable, got", err)
+	}
+}
+
+func TestReader_SetEmitRoot(t *testing.T) {
+	r := NewReader(strings.NewReader(`<?xml version="1.0"?><feed generated="today"><item/></feed>`))
+	r.SetEmitRoot(true)
+
+	var records []*Record
+	for {
+		res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "item" {
+				return RecordsBuilderResult{Records: []*Record{{TypeName: "item"}}}
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		records = append(records, res.Records...)
+		if res.IsEndOfStream {
+			break
+		}
+	}
+
+	if len(records) != 2 || records[0].TypeName != RootTypeName || records[1].TypeName != "item" {
+		t.Fatal("expected the root record ahead of the item record")
+	}
+	root := records[0].Data.(RootElement)
+	if root.Name.Local != "feed" || len(root.Attr) != 1 || root.Attr[0].Value != "today" {
+		t.Fatal("root record did not describe the root element")
+	}
+}
+
+func TestReader_ProcessTokenResultOffset(t *testing.T) {
+	r := NewReader(strings.NewReader(`<a><b/></a>`))
+
+	var offsets []int64
+	for {
+		res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.IsEndOfStream {
+			break
+		}
+		offsets = append(offsets, res.Offset)
+	}
+
+	// <a>, <b/> (start and end), </a>
+	if len(offsets) != 4 || offsets[0] != 3 || offsets[1] != 7 || offsets[3] != 11 {
+		t.Fatalf("unexpected offsets: %v", offsets)
+	}
+}
+
+func TestReader_StreamColumns(t *testing.T) {
+	r := NewReader(strings.NewReader(`<people><person id="1"><name>a</name></person><person id="2"><name>b</name></person><person id="3"><name>c</name></person></people>`))
+	r.SetColumnBatchSize(2)
+
+	var batches []ColumnarBatch
+	err := r.StreamColumns("person", []Column{AttrColumn("id", "id"), TextColumn("name", "name")}, func(batch ColumnarBatch) error {
+		batches = append(batches, batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 || batches[0].Len != 2 || batches[1].Len != 1 {
+		t.Fatal("unexpected batch sizes")
+	}
+	if batches[0].Columns[0][1] != "2" || batches[1].Columns[1][0] != "c" {
+		t.Fatal("unexpected column values")
+	}
+}
+
+func TestReader_StreamBuffered(t *testing.T) {
+	builder := func(tok xml.Token) RecordsBuilderResult {
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "item" {
+			return RecordsBuilderResult{Records: []*Record{{TypeName: "item"}}}
+		}
+		return RecordsBuilderResult{}
+	}
+
+	r := NewReader(strings.NewReader(`<items><item/><item/><item/></items>`))
+	records, errs := r.StreamBuffered(context.Background(), builder, 1)
+	count := 0
+	for range records {
+		count++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatal("expected 3 records")
+	}
+
+	// cancelling stops the parser and closes the channels
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewReader(strings.NewReader(`<items><item/><item/><item/></items>`))
+	records, errs = r.StreamBuffered(ctx, builder, 0)
+	<-records
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("expected the stream to be cancelled")
+	}
+}
+
+func TestReader_DecodePolymorphic(t *testing.T) {
+	type click struct {
+		X int `xml:"x,attr"`
+	}
+	type view struct {
+		Page string `xml:"page"`
+	}
+
+	doc := `<events><event type="click" x="3"/><event type="scroll"/><event type="view"><page>home</page></event></events>`
+
+	r := NewReader(strings.NewReader(doc))
+	r.RegisterType("click", func() interface{} { return &click{} })
+	r.RegisterType("view", func() interface{} { return &view{} })
+	r.SetTolerant(true)
+
+	var records []*Record
+	err := r.DecodePolymorphic("event", "type", func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || r.Skipped() != 1 {
+		t.Fatal("expected the unregistered event to be skipped")
+	}
+	if c, ok := records[0].Data.(*click); !ok || records[0].TypeName != "click" || c.X != 3 {
+		t.Fatal("expected the click event to decode into its type")
+	}
+	if v, ok := records[1].Data.(*view); !ok || records[1].TypeName != "view" || v.Page != "home" {
+		t.Fatal("expected the view event to decode into its type")
+	}
+
+	// outside of tolerant mode, an unregistered discriminator is an error
+	r = NewReader(strings.NewReader(doc))
+	r.RegisterType("click", func() interface{} { return &click{} })
+	if err := r.DecodePolymorphic("event", "type", func(*Record) error { return nil }); err == nil {
+		t.Fatal("expected an error for the unregistered event")
+	}
+}
+
+func TestReader_Validate(t *testing.T) {
+	r := NewReader(strings.NewReader(`<items><item>1</item><item>2</items>`))
+	if err := r.Validate(); err == nil {
+		t.Fatal("expected the mismatched element to fail validation")
+	}
+
+	// the reader's own checks apply, just as they would when parsing
+	for _, doc := range []string{`<a/><b/>`, ``, `<?xml version="1.0"?>  `, `<items><item>1</item></items>`} {
+		r = NewReader(strings.NewReader(doc))
+		r.SetMultiRoot(false)
+		r.SetRequiredAttributes("item", "id")
+		if err := r.Validate(); err == nil {
+			t.Fatal("expected", strconv.Quote(doc), "to fail validation")
+		}
+	}
+
+	r = NewReader(strings.NewReader(`<items><item>1</item><item>2</item></items>`))
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := readText(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "12" {
+		t.Fatal("expected the document to be processed after reset, got", text)
+	}
+}
+
+func TestReader_DecodeParallel(t *testing.T) {
+	type item struct {
+		Id   int    `xml:"id,attr"`
+		Note string `xml:"note"`
+	}
+
+	// only the first item has a note, so a target that isn't reset would leak it into later items
+	doc := `<items><item id="1"><note>first</note></item>`
+	for i := 2; i <= 100; i++ {
+		doc += `<item id="` + strconv.Itoa(i) + `"/>`
+	}
+	doc += `</items>`
+
+	var mutex sync.Mutex
+	sum, notes := 0, 0
+	err := NewReader(strings.NewReader(doc)).DecodeParallel("item", 4, func() interface{} {
+		return &item{}
+	}, func(v interface{}) error {
+		it := v.(*item)
+		mutex.Lock()
+		sum += it.Id
+		if it.Note != "" {
+			notes++
+		}
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 5050 || notes != 1 {
+		t.Fatal("expected every item to be decoded into a clean target, got", sum, notes)
+	}
+
+	err = NewReader(strings.NewReader(doc)).DecodeParallel("item", 4, func() interface{} {
+		return &item{}
+	}, func(v interface{}) error {
+		return errors.New("handler failed")
+	})
+	if err == nil || err.Error() != "handler failed" {
+		t.Fatal("expected the handler error, got", err)
+	}
+}
+
+// benchmarkDocument is a document of n small records, for the parallel decode benchmarks
+func benchmarkDocument(n int) string {
+	var sb strings.Builder
+	sb.WriteString("<items>")
+	for i := 0; i < n; i++ {
+		sb.WriteString(`<item id="` + strconv.Itoa(i) + `"><name>name</name><street>street</street></item>`)
+	}
+	sb.WriteString("</items>")
+	return sb.String()
+}
+
+type benchmarkItem struct {
+	Id     int    `xml:"id,attr"`
+	Name   string `xml:"name"`
+	Street string `xml:"street"`
+}
+
+func BenchmarkReader_DecodeParallel(b *testing.B) {
+	doc := benchmarkDocument(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := NewReader(strings.NewReader(doc)).DecodeParallel("item", 4, func() interface{} {
+			return &benchmarkItem{}
+		}, func(v interface{}) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReader_DecodeParallelNaive allocates a fresh target per record, as a baseline for the pooled targets in
+// DecodeParallel
+func BenchmarkReader_DecodeParallelNaive(b *testing.B) {
+	doc := benchmarkDocument(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		work := make(chan interface{})
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range work {
+				}
+			}()
+		}
+
+		r := NewReader(strings.NewReader(doc))
+		for {
+			t, err := r.token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			if se, ok := t.(xml.StartElement); ok && se.Name.Local == "item" {
+				v := &benchmarkItem{}
+				if err := r.DecodeToken(v, &se); err != nil {
+					b.Fatal(err)
+				}
+				work <- v
+			}
+		}
+
+		close(work)
+		wg.Wait()
+	}
+}
+
+func TestReader_SetForceEncoding(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?><a>héllo</a>`
+
+	// UTF-16LE, with no BOM
+	var encoded []byte
+	for _, c := range utf16.Encode([]rune(doc)) {
+		encoded = append(encoded, byte(c), byte(c>>8))
+	}
+
+	r := NewReader(bytes.NewReader(encoded))
+	r.SetForceEncoding("utf-16le")
+	text, err := readText(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "héllo" {
+		t.Fatal("expected the input to be decoded as UTF-16LE, got", text)
+	}
+
+	r = NewReader(bytes.NewReader(encoded))
+	r.SetForceEncoding("no-such-encoding")
+	if _, err := readText(r); err == nil {
+		t.Fatal("expected an unknown encoding to fail the read")
+	}
+}
+
+func TestReader_StreamMessages(t *testing.T) {
+	type message struct {
+		Body string `xml:"body"`
+	}
+
+	pr, pw := io.Pipe()
+	received := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- NewReader(pr).StreamMessages(func() interface{} {
+			return &message{}
+		}, func(v interface{}) error {
+			received <- v.(*message).Body
+			return nil
+		})
+	}()
+
+	// each message is delivered as soon as it's complete, without waiting on the rest of the stream
+	for _, body := range []string{"one", "two"} {
+		if _, err := pw.Write([]byte(`<?xml version="1.0"?><message><body>` + body + `</body></message>`)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; got != body {
+			t.Fatal("expected message", body, "got", got)
+		}
+	}
+
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("expected the stream closing between messages to end cleanly, got", err)
+	}
+
+	// closing mid-message is an error
+	err := NewReader(strings.NewReader(`<message><body>one</body></message><message><body>`)).StreamMessages(func() interface{} {
+		return &message{}
+	}, func(interface{}) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected an error for the truncated message")
+	}
+}
+
+func TestReader_DecodeRaw(t *testing.T) {
+	type payload struct {
+		Amount int `xml:"amount"`
+	}
+
+	doc := `<records><record><amount>5</amount><note a="1">x</note></record></records>`
+	for _, transform := range []bool{false, true} {
+		r := NewReader(strings.NewReader(doc))
+		if transform {
+			r.SetTextTransform(func(elementName, text string) (string, error) {
+				return text, nil
+			})
+		}
+
+		var raw RawXML
+		for {
+			tok, err := r.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "record" {
+				if raw, err = r.DecodeRaw(&se); err != nil {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+
+		if string(raw) != `<amount>5</amount><note a="1">x</note>` {
+			t.Fatal("expected the inner markup to be captured, got", string(raw))
+		}
+
+		p := payload{}
+		if err := raw.Unmarshal(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Amount != 5 {
+			t.Fatal("expected the raw content to unmarshal later")
+		}
+	}
+}
+
+// saxRecorder records the events it receives, failing on the element named by failOn
+type saxRecorder struct {
+	events []string
+	failOn string
+}
+
+func (s *saxRecorder) StartElement(name string, attrs []xml.Attr) error {
+	if name == s.failOn {
+		return errors.New("failed on " + name)
+	}
+	event := "<" + name
+	for _, attr := range attrs {
+		event += " " + attr.Name.Local + "=" + attr.Value
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *saxRecorder) EndElement(name string) error {
+	s.events = append(s.events, "/"+name)
+	return nil
+}
+
+func (s *saxRecorder) CharData(data []byte) error {
+	s.events = append(s.events, string(data))
+	return nil
+}
+
+func TestReader_Drive(t *testing.T) {
+	doc := `<a x="1"><b>text</b><c/></a>`
+
+	h := &saxRecorder{}
+	if err := NewReader(strings.NewReader(doc)).Drive(h); err != nil {
+		t.Fatal(err)
+	}
+	if events := strings.Join(h.events, ","); events != "<a x=1,<b,text,/b,<c,/c,/a" {
+		t.Fatal("unexpected events:", events)
+	}
+
+	h = &saxRecorder{failOn: "c"}
+	if err := NewReader(strings.NewReader(doc)).Drive(h); err == nil || len(h.events) != 4 {
+		t.Fatal("expected the walk to stop at the handler error")
+	}
+}
+
+func TestReader_SetMultiRoot(t *testing.T) {
+	type entry struct {
+		Id int `xml:"id,attr"`
+	}
+	doc := `<log><entry id="1"/></log><log><entry id="2"/><entry id="3"/></log>`
+
+	// like encoding/xml, a second root isn't checked for by default
+	target := entry{}
+	count := 0
+	err := NewReader(strings.NewReader(doc)).DecodeEach("entry", &target, func() error {
+		count++
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Fatal("expected a second root to be accepted by default, got", count, "entries and", err)
+	}
+
+	r := NewReader(strings.NewReader(doc))
+	r.SetMultiRoot(false)
+	err = r.DecodeEach("entry", &target, func() error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "second root") {
+		t.Fatal("expected a second root to fail the read when a single root is asked for, got", err)
+	}
+
+	r = NewReader(strings.NewReader(doc))
+	r.SetMultiRoot(true)
+	sum := 0
+	err = r.DecodeEach("entry", &target, func() error {
+		sum += target.Id
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 6 {
+		t.Fatal("expected the entries of every root to be decoded")
+	}
+}
+
+func TestReader_SetRequiredAttributes(t *testing.T) {
+	type item struct {
+		Id string `xml:"id,attr"`
+	}
+	doc := `<items><item id="1" kind="a"/><item kind="b"/><item id="3" kind="c"/></items>`
+
+	r := NewReader(strings.NewReader(doc))
+	r.SetRequiredAttributes("item", "id", "kind")
+	target := item{}
+	err := r.DecodeEach("item", &target, func() error { return nil })
+	var missing *MissingAttributesError
+	if !errors.As(err, &missing) || missing.Attributes[0] != "id" || missing.Offset == 0 {
+		t.Fatal("expected a missing attribute error, got", err)
+	}
+
+	r = NewReader(strings.NewReader(doc))
+	r.SetRequiredAttributes("item", "id", "kind")
+	r.SetTolerant(true)
+	var ids []string
+	err = r.DecodeEach("item", &target, func() error {
+		ids = append(ids, target.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ids, ",") != "1,3" || r.Skipped() != 1 {
+		t.Fatal("expected the element missing an attribute to be skipped, got", ids)
+	}
+}
+
+func TestReader_DecodeFields(t *testing.T) {
+	doc := `<people>
+		<person id="1"><name>Ann</name><bio>long text</bio><address kind="home"><city>Oslo</city></address><address kind="work"><city>Bergen</city></address></person>
+		<person id="2"><name>Bob</name></person>
+	</people>`
+
+	var rows []map[string]string
+	err := NewReader(strings.NewReader(doc)).DecodeFields("person", []string{"@id", "name", "address/city", "address/@kind"}, func(row map[string]string) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatal("expected a row per person, got", rows)
+	}
+
+	first := rows[0]
+	if first["@id"] != "1" || first["name"] != "Ann" || first["address/city"] != "Oslo" || first["address/@kind"] != "home" || len(first) != 4 {
+		t.Fatal("unexpected first row:", first)
+	}
+	if _, ok := rows[1]["address/city"]; ok || rows[1]["name"] != "Bob" {
+		t.Fatal("expected the missing fields to be left out of the second row, got", rows[1])
+	}
+}
+
+func TestReader_DecodeToMap(t *testing.T) {
+	doc := `<orders>
+		<Order OrderID="7"><ShipTo kind="home">Oslo</ShipTo><line-item>a</line-item><line-item>b</line-item><Notes/></Order>
+	</orders>`
+
+	var items []map[string]interface{}
+	err := NewReader(strings.NewReader(doc)).DecodeToMap("Order", func(m map[string]interface{}) error {
+		items = append(items, m)
+		return nil
+	}, SnakeKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatal("expected one order, got", items)
+	}
+
+	order := items[0]
+	if order["@order_id"] != "7" || order["notes"] != "" {
+		t.Fatal("unexpected order:", order)
+	}
+	shipTo, ok := order["ship_to"].(map[string]interface{})
+	if !ok || shipTo["@kind"] != "home" || shipTo["#text"] != "Oslo" {
+		t.Fatal("expected ship_to to hold its attribute and text, got", order["ship_to"])
+	}
+	lines, ok := order["line_item"].([]interface{})
+	if !ok || len(lines) != 2 || lines[0] != "a" || lines[1] != "b" {
+		t.Fatal("expected the repeated line items as a slice, got", order["line_item"])
+	}
+
+	for name, want := range map[string]string{"OrderID": "orderid", "shipTo": "shipto"} {
+		if got := mapKey(name, LowerKeys); got != want {
+			t.Fatal("expected", want, "got", got)
+		}
+	}
+	if got := mapKey("OrderID", PreserveKeys); got != "OrderID" {
+		t.Fatal("expected the name to be preserved, got", got)
+	}
+}
+
+func TestReader_SetDuplicateAttributePolicy(t *testing.T) {
+	se := xml.StartElement{
+		Name: xml.Name{Local: "item"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "id"}, Value: "1"},
+			{Name: xml.Name{Local: "kind"}, Value: "a"},
+			{Name: xml.Name{Local: "id"}, Value: "2"},
+		},
+	}
+
+	r := NewReader(strings.NewReader(""))
+	if attrs, err := r.Attributes(se); err != nil || attrs[QName{Local: "id"}] != "1" || attrs[QName{Local: "kind"}] != "a" {
+		t.Fatal("expected the first occurrence by default, got", attrs, err)
+	}
+
+	r.SetDuplicateAttributePolicy(LastDuplicateAttribute)
+	if value, ok, err := r.Attribute(se, "id"); err != nil || !ok || value != "2" {
+		t.Fatal("expected the last occurrence, got", value, ok, err)
+	}
+
+	r.SetDuplicateAttributePolicy(ErrorOnDuplicateAttribute)
+	if value, ok, err := r.Attribute(se, "kind"); err != nil || !ok || value != "a" {
+		t.Fatal("expected an attribute that isn't repeated to be read, got", value, ok, err)
+	}
+	_, err := r.Attributes(se)
+	var dupErr *DuplicateAttributeError
+	if !errors.As(err, &dupErr) || dupErr.Element != "item" || dupErr.Attribute != "id" {
+		t.Fatal("expected a duplicate attribute error, got", err)
+	}
+
+	// attributes that only share a local name aren't repeats
+	doc := `<html xml:lang="en" lang="fr"/>`
+	r = NewReader(strings.NewReader(doc))
+	r.SetDuplicateAttributePolicy(ErrorOnDuplicateAttribute)
+	tok, err := r.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := tok.(xml.StartElement)
+	attrs, err := r.Attributes(html)
+	if err != nil || len(attrs) != 2 || attrs[QName{Local: "lang"}] != "fr" {
+		t.Fatal("expected both lang attributes, got", attrs, err)
+	}
+	if value, ok, err := r.Attribute(html, "lang"); err != nil || !ok || value != "en" {
+		t.Fatal("expected the first lang attribute by local name, got", value, ok, err)
+	}
+
+	// the policy applies to polymorphic discriminators too
+	doc = `<items><item type="a" type="b"/></items>`
+	r = NewReader(strings.NewReader(doc))
+	r.SetDuplicateAttributePolicy(ErrorOnDuplicateAttribute)
+	r.RegisterType("a", func() interface{} { return &struct{}{} })
+	err = r.DecodePolymorphic("item", "type", func(*Record) error {
+		return nil
+	})
+	if !errors.As(err, &dupErr) || dupErr.Offset == 0 {
+		t.Fatal("expected a duplicate attribute error with an offset, got", err)
+	}
+}
+
+func TestReader_BuildRecordsFromTokenNS(t *testing.T) {
+	doc := `<items xmlns:a="urn:a" xmlns:b="urn:b"><a:item>1</a:item><b:item>2</b:item><item>3</item></items>`
+	r := NewReader(strings.NewReader(doc))
+
+	var matched []string
+	for {
+		res := r.BuildRecordsFromTokenNS(func(t xml.Token, qname QName) RecordsBuilderResult {
+			if _, ok := t.(xml.StartElement); ok && qname.Matches("{urn:b}item") {
+				matched = append(matched, qname.String())
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.IsEndOfStream {
+			break
+		}
+	}
+	if strings.Join(matched, ",") != "{urn:b}item" {
+		t.Fatal("expected only the item in the b namespace to match, got", matched)
+	}
+
+	if !ParseQName("{urn:a}item").Matches("{urn:a}*") || ParseQName("item").Matches("{urn:a}item") || !ParseQName("item").Matches("item") {
+		t.Fatal("unexpected pattern matching")
+	}
+}
+
+func TestReader_BuildIndex(t *testing.T) {
+	type item struct {
+		Id int `xml:"id,attr"`
+	}
+
+	content := "<?xml version=\"1.0\"?>\n<items>\n  <item id=\"1\"><item id=\"9\"/></item>\n  <other/><item id=\"2\">text</item><item id=\"3\"/>\n</items>"
+	offsets, err := NewReader(strings.NewReader(content)).BuildIndex("item")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 3 {
+		t.Fatal("expected an offset per item, skipping nested ones, got", offsets)
+	}
+
+	r := NewReaderAt(strings.NewReader(content), int64(len(content)))
+	for n, offset := range offsets {
+		i := item{}
+		if err := r.DecodeElementAt(offset, &i); err != nil {
+			t.Fatal(err)
+		}
+		if i.Id != n+1 {
+			t.Fatal("expected offset", offset, "to locate item", n+1, "got", i.Id)
+		}
+	}
+}
+
+func TestReader_DecodeWithNamespaces(t *testing.T) {
+	type item struct {
+		Type string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	}
+
+	doc := `<feed xmlns="urn:feed" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+		<group xmlns:k="urn:kinds-1"><item xsi:type="k:Widget"/></group>
+		<group xmlns:k="urn:kinds-2"><item xmlns:x="urn:x" xsi:type="k:Gadget"/></group>
+	</feed>`
+
+	var resolved []string
+	err := NewReader(strings.NewReader(doc)).DecodeWithNamespaces("item", func() interface{} {
+		return &item{}
+	}, func(v interface{}, ns map[string]string) error {
+		qname := strings.SplitN(v.(*item).Type, ":", 2)
+		resolved = append(resolved, "{"+ns[qname[0]]+"}"+qname[1])
+		if ns[""] != "urn:feed" {
+			t.Fatal("expected the default namespace to be in scope, got", ns)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resolved, ",") != "{urn:kinds-1}Widget,{urn:kinds-2}Gadget" {
+		t.Fatal("expected each QName to resolve against the declarations in scope, got", resolved)
+	}
+}
+
+func TestReader_SetEmitSummary(t *testing.T) {
+	r := NewReader(strings.NewReader(`<feed><a/><b/><a/></feed>`))
+	r.SetEmitSummary(true)
+
+	var records []*Record
+	for {
+		res := r.BuildRecordsFromToken(func(tok xml.Token) RecordsBuilderResult {
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Local != "feed" {
+				return RecordsBuilderResult{Records: []*Record{{TypeName: se.Name.Local}}}
+			}
+			return RecordsBuilderResult{}
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		records = append(records, res.Records...)
+		if res.IsEndOfStream {
+			break
+		}
+	}
+
+	if len(records) != 4 || records[3].TypeName != SummaryTypeName {
+		t.Fatal("expected a summary record to end the stream")
+	}
+	counts := records[3].Data.(map[string]int)
+	if counts["a"] != 2 || counts["b"] != 1 || len(counts) != 2 {
+		t.Fatal("unexpected counts:", counts)
+	}
+}
@@ -0,0 +1,64 @@
+package xml
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// MissingAttributesError is returned for an element lacking attributes required of it by SetRequiredAttributes
+type MissingAttributesError struct {
+	Element    string
+	Attributes []string
+
+	// Offset is the input offset just after the element's start tag
+	Offset int64
+}
+
+func (e *MissingAttributesError) Error() string {
+	return "element " + strconv.Quote(e.Element) + " at offset " + strconv.FormatInt(e.Offset, 10) +
+		" is missing required attributes: " + strings.Join(e.Attributes, ", ")
+}
+
+// SetRequiredAttributes requires every elementName element to carry the given attributes (by local name), which is
+// checked as each element starts, before anything decodes it - an element that lacks any of them fails the read with a
+// *MissingAttributesError, or in tolerant mode is skipped.  Calling it again for the same element replaces its
+// requirements.
+func (r *Reader) SetRequiredAttributes(elementName string, attrs ...string) {
+	if r.requiredAttrs == nil {
+		r.requiredAttrs = make(map[string][]string)
+	}
+	r.requiredAttrs[elementName] = attrs
+}
+
+// checkRequired returns an error if the token is the start of an element missing required attributes
+func (r *Reader) checkRequired(t xml.Token) error {
+	se, ok := t.(xml.StartElement)
+	if !ok {
+		return nil
+	}
+
+	required, ok := r.requiredAttrs[se.Name.Local]
+	if !ok {
+		return nil
+	}
+
+	var missing []string
+	for _, name := range required {
+		found := false
+		for _, attr := range se.Attr {
+			if attr.Name.Local == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	return &MissingAttributesError{Element: se.Name.Local, Attributes: missing, Offset: r.Offset()}
+}
@@ -0,0 +1,38 @@
+package xml
+
+import "encoding/xml"
+
+// RootTypeName is the TypeName of the record describing the document root (see SetEmitRoot) - it can't collide with a
+// real element name, as '#' isn't allowed in XML names
+const RootTypeName = "#root"
+
+// RootElement is the Data of the root record, holding the root element's name and attributes
+type RootElement struct {
+	Name xml.Name
+	Attr []xml.Attr
+}
+
+// SetEmitRoot makes BuildRecordsFromToken emit a record describing the document's root element (with TypeName
+// RootTypeName and a RootElement as its Data) ahead of the records built from the root's start token.  This surfaces
+// feed-level metadata carried on the root's attributes (like a generation timestamp) through the same record stream.
+// With SetMultiRoot, a record is emitted for each root.
+func (r *Reader) SetEmitRoot(emit bool) {
+	r.emitRoot = emit
+}
+
+// rootRecord returns the root record if the token is the root's start and one should be emitted
+func (r *Reader) rootRecord(t xml.Token) *Record {
+	se, ok := t.(xml.StartElement)
+	if !ok || !r.emitRoot || (r.rootEmitted && !r.multiRoot) || r.depth != 1 {
+		return nil
+	}
+
+	r.rootEmitted = true
+	return &Record{
+		TypeName: RootTypeName,
+		Data: RootElement{
+			Name: se.Name,
+			Attr: se.Copy().Attr,
+		},
+	}
+}
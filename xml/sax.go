@@ -0,0 +1,42 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// SAXHandler receives the document's structure as a series of events, for stateful processing of complex documents -
+// a structured alternative to a RecordsBuilderFunction
+type SAXHandler interface {
+	StartElement(name string, attrs []xml.Attr) error
+	EndElement(name string) error
+
+	// CharData receives text content - data is only valid for the duration of the call, so copy it to retain it
+	CharData(data []byte) error
+}
+
+// Drive walks the document's tokens, dispatching each element start, element end and text node to the handler (by
+// local name), until the input is exhausted or the handler (or the input) fails
+func (r *Reader) Drive(h SAXHandler) error {
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tok := t.(type) {
+		case xml.StartElement:
+			err = h.StartElement(tok.Name.Local, tok.Attr)
+		case xml.EndElement:
+			err = h.EndElement(tok.Name.Local)
+		case xml.CharData:
+			err = h.CharData(tok)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package xml
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotSeekable is returned by methods that need to seek (Reset and DecodeElementAt) when the input can't
+var ErrNotSeekable = errors.New("input is not seekable")
+
+// Seekable reports whether the reader's input supports seeking, which is all that the methods that need it (Reset and
+// DecodeElementAt) require - true for readers from Open and NewReaderAt, and for readers over an io.ReadSeeker (such
+// as *bytes.Reader and *strings.Reader).  When it's false, those methods return ErrNotSeekable.  Everything else works
+// on any input, seekable or not.
+func (r *Reader) Seekable() bool {
+	if r.readerAt != nil {
+		return true
+	}
+	_, ok := r.source.(io.Seeker)
+	return ok
+}
+
+// randomAccess returns the input as an io.ReaderAt, along with its size, or ErrNotSeekable if it can't be read that way
+func (r *Reader) randomAccess() (io.ReaderAt, int64, error) {
+	if r.readerAt != nil {
+		return r.readerAt, r.size, nil
+	}
+	seeker, ok := r.source.(io.ReadSeeker)
+	if !ok {
+		return nil, 0, ErrNotSeekable
+	}
+
+	ra, ok := r.source.(io.ReaderAt)
+	if !ok {
+		ra = &seekingReaderAt{seeker}
+	}
+	if r.size >= 0 {
+		return ra, r.size, nil
+	}
+
+	// find the size by seeking to the end, then back to where the decoder left off
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return ra, size, nil
+}
+
+// seekingReaderAt reads at an offset by seeking there, then seeking back to where the stream was, so the decoder
+// reading from it carries on undisturbed - it isn't safe for concurrent use, but neither is the reader
+type seekingReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s *seekingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	current, err := s.rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if _, seekErr := s.rs.Seek(current, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	return n, err
+}
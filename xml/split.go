@@ -0,0 +1,70 @@
+package xml
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+)
+
+// maxSplitDocumentSize caps the size of a single document produced by SplitDocuments
+const maxSplitDocumentSize = 64 * 1024 * 1024
+
+// SplitDocuments handles input made of several XML documents in one stream (e.g. documents concatenated with a separator
+// line), which a single decoder chokes on after the first root element.  The remaining input is split into documents
+// with split, and onDocument is called with a reader per document - each gets its own decoder and this reader's
+// options.  Documents are held in memory while being processed, up to 64MB each.  It must be called before any tokens
+// are read from this reader.
+func (r *Reader) SplitDocuments(split bufio.SplitFunc, onDocument func(*Reader) error) error {
+	if r.decoder != nil {
+		return errors.New("documents must be split before any tokens are read")
+	}
+
+	scanner := bufio.NewScanner(r.source)
+	scanner.Buffer(make([]byte, 64*1024), maxSplitDocumentSize)
+	scanner.Split(split)
+
+	for scanner.Scan() {
+		doc := scanner.Bytes()
+
+		// skip empty documents, e.g. from a trailing separator
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		// the scanner reuses its buffer, so each document gets its own copy
+		doc = append([]byte(nil), doc...)
+		if err := onDocument(r.derive(bytes.NewReader(doc), int64(len(doc)))); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// SeparatorSplit returns a split function for SplitDocuments that splits the input on lines consisting solely of sep
+func SeparatorSplit(sep string) bufio.SplitFunc {
+	separator := []byte(sep)
+
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		start := 0
+		for start <= len(data) {
+			end := bytes.IndexByte(data[start:], '\n')
+			if end < 0 {
+				break
+			}
+
+			line := bytes.TrimRight(data[start:start+end], "\r")
+			if bytes.Equal(bytes.TrimSpace(line), separator) {
+				return start + end + 1, data[:start], nil
+			}
+			start += end + 1
+		}
+
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		// request more data
+		return 0, nil, nil
+	}
+}
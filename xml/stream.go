@@ -0,0 +1,168 @@
+package xml
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// DecodeHeaderThenStream handles the common document shape of a header element (metadata) followed by a long list of
+// records.  The header element is decoded into header, then each recordName element is decoded into a value from newFn
+// and handed to onItem.  It's an error for the header to be missing, repeated, or to appear after a record.
+func (r *Reader) DecodeHeaderThenStream(
+	headerName string,
+	header interface{},
+	recordName string,
+	newFn func() interface{},
+	onItem func(interface{}) error,
+) error {
+	seenHeader := false
+
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			if !seenHeader {
+				return errors.New("header element " + strconv.Quote(headerName) + " not found")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case headerName:
+			if seenHeader {
+				return errors.New("header element " + strconv.Quote(headerName) + " appeared more than once")
+			}
+			if err := r.DecodeToken(header, &se); err != nil {
+				return err
+			}
+			seenHeader = true
+		case recordName:
+			if !seenHeader {
+				return errors.New("record element " + strconv.Quote(recordName) + " appeared before header element " + strconv.Quote(headerName))
+			}
+			v := newFn()
+			if err := r.DecodeToken(v, &se); err != nil {
+				return err
+			}
+			if err := onItem(v); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DecodeEach is the allocation-free hot path for uniform record streams: each elementName element is decoded into the
+// same target, and onItem is called after each decode.  target is overwritten every iteration, so it must not be
+// retained by onItem - and since decoding only sets what the element contains (and appends to slices), the caller should
+// reset target before the next decode when elements may omit fields.
+func (r *Reader) DecodeEach(elementName string, target interface{}, onItem func() error) error {
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != elementName {
+			continue
+		}
+
+		if err := r.DecodeToken(target, &se); err != nil {
+			return err
+		}
+		if err := onItem(); err != nil {
+			return err
+		}
+	}
+}
+
+// StreamBuffered runs the parser in its own goroutine, delivering built records through a channel with capacity
+// bufSize, so parsing runs ahead of the consumer by a bounded amount - decoupling parse speed from consume speed while
+// bounding memory.  The record channel is closed once the input is exhausted, an error occurs, or ctx is done; any error
+// (including ctx's) is then delivered on the error channel, which is closed afterwards.  The builder runs on the parser
+// goroutine, and the reader must not otherwise be used until the record channel is closed.
+func (r *Reader) StreamBuffered(ctx context.Context, recordsBuilder RecordsBuilderFunction, bufSize int) (<-chan *Record, <-chan error) {
+	records := make(chan *Record, bufSize)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(records)
+
+		for {
+			// stop promptly when cancelled, even if the builder isn't producing records
+			if err := ctx.Err(); err != nil {
+				errs <- err
+				return
+			}
+
+			res := r.BuildRecordsFromToken(recordsBuilder)
+			for _, record := range res.Records {
+				select {
+				case records <- record:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+
+			if res.Err != nil {
+				errs <- res.Err
+				return
+			}
+			if res.IsEndOfStream {
+				return
+			}
+		}
+	}()
+
+	return records, errs
+}
+
+// StreamMessages reads an endless sequence of top-level elements from a long-lived stream (as in XML-over-TCP
+// protocols), decoding each into a value from newFn and handing it to onItem as soon as it's complete - no read-ahead
+// past the message is needed, so the stream needn't be seekable or ever end.  Anything between messages (whitespace,
+// repeated XML declarations) is ignored.  The stream ending between messages ends the loop cleanly; ending (or failing)
+// mid-message is reported as an error.
+func (r *Reader) StreamMessages(newFn func() interface{}, onItem func(interface{}) error) error {
+	r.messageStream = true
+	defer func() {
+		r.messageStream = false
+	}()
+
+	for {
+		t, err := r.token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || r.depth != 1 {
+			continue
+		}
+
+		v := newFn()
+		if err := r.DecodeToken(v, &se); err != nil {
+			return err
+		}
+		if err := onItem(v); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package xml
+
+// SummaryTypeName is the TypeName of the summary record (see SetEmitSummary) - like RootTypeName, it can't collide with
+// a real element name
+const SummaryTypeName = "#summary"
+
+// SetEmitSummary makes BuildRecordsFromToken emit a final record at the end of the stream, with TypeName
+// SummaryTypeName and a map[string]int of how many records it built of each TypeName as its Data (the summary itself
+// and the root record aren't counted) - so downstream code can validate totals inline with the stream
+func (r *Reader) SetEmitSummary(emit bool) {
+	r.emitSummary = emit
+}
+
+// countRecords adds the records to the per-type counts, if a summary will be emitted
+func (r *Reader) countRecords(records []*Record) {
+	if !r.emitSummary {
+		return
+	}
+
+	if r.recordCounts == nil {
+		r.recordCounts = make(map[string]int)
+	}
+	for _, record := range records {
+		r.recordCounts[record.TypeName]++
+	}
+}
+
+// summaryRecords returns the summary record at the end of the stream, if one should be emitted
+func (r *Reader) summaryRecords() []*Record {
+	if !r.emitSummary || r.summaryEmitted {
+		return nil
+	}
+	r.summaryEmitted = true
+
+	counts := make(map[string]int, len(r.recordCounts))
+	for typeName, count := range r.recordCounts {
+		counts[typeName] = count
+	}
+	return []*Record{{TypeName: SummaryTypeName, Data: counts}}
+}
@@ -0,0 +1,297 @@
+package xml
+
+import (
+	"encoding"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Element is a generic representation of a decoded element - Text is all of the element's character data
+// (including that between child elements), concatenated
+type Element struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []*Element `xml:",any"`
+}
+
+// Child returns the first child element with the given local name, or nil if there isn't one
+func (e *Element) Child(name string) *Element {
+	for _, child := range e.Children {
+		if child.XMLName.Local == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// ChildText returns the text of the first child element with the given local name, or "" if there isn't one
+func (e *Element) ChildText(name string) string {
+	if child := e.Child(name); child != nil {
+		return child.Text
+	}
+	return ""
+}
+
+// Attr returns the value of the attribute with the given local name
+func (e *Element) Attr(name string) (string, bool) {
+	for _, attr := range e.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetTagPreference configures which struct tags DecodeToken consults, in order, to map elements onto struct fields -
+// e.g. []string{"xml", "json"} uses the xml tag when present and falls back to the json tag.  Fields with none of the
+// tags are matched by field name.  Any preference other than the default ([]string{"xml"}, or nil) decodes through a
+// reflective mapper rather than encoding/xml itself, which supports the common tag forms (name, "-", and the xml attr
+// and chardata options) but not ones like innerxml or a>b paths.  Elements match a field by name (falling back to a
+// case-insensitive match, like encoding/json), then by attribute if no child element matches.
+func (r *Reader) SetTagPreference(tags []string) {
+	r.tagPreference = tags
+}
+
+func (r *Reader) usesTagPreference() bool {
+	return len(r.tagPreference) > 0 && !(len(r.tagPreference) == 1 && r.tagPreference[0] == "xml")
+}
+
+// fieldMapping describes how a struct field maps to parts of an element
+type fieldMapping struct {
+	name     string
+	attr     bool
+	chardata bool
+	skip     bool
+}
+
+func mappingForField(field reflect.StructField, tags []string) fieldMapping {
+	for _, tagName := range tags {
+		tag, ok := field.Tag.Lookup(tagName)
+		if !ok {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		if parts[0] == "-" && len(parts) == 1 {
+			return fieldMapping{skip: true}
+		}
+
+		m := fieldMapping{name: parts[0]}
+		if tagName == "xml" {
+			for _, opt := range parts[1:] {
+				switch opt {
+				case "attr":
+					m.attr = true
+				case "chardata":
+					m.chardata = true
+				}
+			}
+		}
+		if m.name == "" {
+			m.name = field.Name
+		}
+		return m
+	}
+
+	return fieldMapping{name: field.Name}
+}
+
+// assignNode maps the generic element onto v, which must be a non-nil pointer
+func assignNode(v interface{}, n *Element, tags []string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+	return assignValue(rv.Elem(), n, tags)
+}
+
+func assignValue(v reflect.Value, n *Element, tags []string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return assignValue(v.Elem(), n, tags)
+	}
+
+	// types like time.Time know how to parse themselves
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(strings.TrimSpace(n.Text)))
+		}
+	}
+
+	if v.Kind() != reflect.Struct {
+		return assignText(v, n.Text)
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Name == "XMLName" {
+			continue
+		}
+
+		m := mappingForField(field, tags)
+		if m.skip {
+			continue
+		}
+
+		fv := v.Field(i)
+
+		// untagged embedded structs are flattened, like encoding/json
+		if field.Anonymous && field.Tag == "" && indirectType(field.Type).Kind() == reflect.Struct {
+			if err := assignValue(fv, n, tags); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if m.chardata {
+			if err := assignText(fv, n.Text); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !m.attr {
+			children := n.childrenNamed(m.name)
+			if len(children) > 0 {
+				if err := assignChildren(fv, children, tags); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if value, ok := n.attrNamed(m.name); ok {
+			if err := assignText(fv, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// assignChildren sets the field from the matching child elements - slices get every child, anything else the first
+func assignChildren(v reflect.Value, children []*Element, tags []string) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		for _, child := range children {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := assignValue(item, child, tags); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, item))
+		}
+		return nil
+	}
+
+	return assignValue(v, children[0], tags)
+}
+
+// assignText sets a scalar value from text, trimming whitespace for non-string kinds as encoding/xml does
+func assignText(v reflect.Value, text string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return assignText(v.Elem(), text)
+	}
+
+	trimmed := strings.TrimSpace(text)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			v.Set(reflect.ValueOf(text))
+		}
+	case reflect.Bool:
+		if trimmed == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(trimmed)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if trimmed == "" {
+			return nil
+		}
+		i, err := strconv.ParseInt(trimmed, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if trimmed == "" {
+			return nil
+		}
+		u, err := strconv.ParseUint(trimmed, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if trimmed == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(trimmed, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(text))
+		}
+	}
+	return nil
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// childrenNamed returns the child elements with the given local name, falling back to a case-insensitive match
+func (n *Element) childrenNamed(name string) []*Element {
+	var results []*Element
+	for _, child := range n.Children {
+		if child.XMLName.Local == name {
+			results = append(results, child)
+		}
+	}
+	if len(results) > 0 {
+		return results
+	}
+
+	for _, child := range n.Children {
+		if strings.EqualFold(child.XMLName.Local, name) {
+			results = append(results, child)
+		}
+	}
+	return results
+}
+
+// attrNamed returns the value of the attribute with the given local name, falling back to a case-insensitive match
+func (n *Element) attrNamed(name string) (string, bool) {
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	for _, attr := range n.Attrs {
+		if strings.EqualFold(attr.Name.Local, name) {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,58 @@
+package xml
+
+import (
+	"encoding/xml"
+	"sync/atomic"
+)
+
+// SetTextTransform normalizes text content as it's parsed (decoding embedded base64, trimming, translating, etc.),
+// before it reaches the builder or is assembled into decoded structs.  transform is called for every text node,
+// including whitespace between elements, with the local name of the element containing it.  A transform error fails the
+// read, or in tolerant mode drops the text node.  It must be set before the first token is read.
+func (r *Reader) SetTextTransform(transform func(elementName, text string) (string, error)) {
+	r.textTransform = transform
+}
+
+// textTransformer sits between the raw decoder and the one the reader hands out, applying the text transform to
+// character data
+type textTransformer struct {
+	source *xml.Decoder
+	reader *Reader
+	names  []string
+}
+
+func (t *textTransformer) Token() (xml.Token, error) {
+	for {
+		// raw tokens are passed on, so namespaces and nesting are handled by the outer decoder
+		tok, err := t.source.RawToken()
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := tok.(type) {
+		case xml.StartElement:
+			t.names = append(t.names, v.Name.Local)
+		case xml.EndElement:
+			if len(t.names) > 0 {
+				t.names = t.names[:len(t.names)-1]
+			}
+		case xml.CharData:
+			name := ""
+			if len(t.names) > 0 {
+				name = t.names[len(t.names)-1]
+			}
+
+			text, err := t.reader.textTransform(name, string(v))
+			if err != nil {
+				if t.reader.tolerant {
+					atomic.AddInt64(&t.reader.skipped, 1)
+					continue
+				}
+				return nil, err
+			}
+			return xml.CharData(text), nil
+		}
+
+		return tok, nil
+	}
+}
@@ -0,0 +1,113 @@
+package xml
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// UTF8Policy determines how the reader treats invalid UTF-8 in its input
+type UTF8Policy int
+
+const (
+	// UTF8Pass hands the input to encoding/xml untouched (the default) - note that encoding/xml rejects invalid UTF-8
+	// with a syntax error for the whole document
+	UTF8Pass UTF8Policy = iota
+
+	// UTF8Reject fails with a *UTF8Error that carries the byte offset of the invalid sequence
+	UTF8Reject
+
+	// UTF8Sanitize replaces each invalid byte with the Unicode replacement character
+	UTF8Sanitize
+)
+
+// UTF8Error is returned under UTF8Reject when the input contains invalid UTF-8
+type UTF8Error struct {
+	Offset int64
+}
+
+func (e *UTF8Error) Error() string {
+	return "invalid UTF-8 at byte offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+// SetUTF8Policy configures how invalid UTF-8 in the input is handled.  The policy applies to the raw bytes of documents
+// encoded as UTF-8 - input in another declared encoding is converted by the charset reader, which always yields valid
+// UTF-8.  It must be set before the first token is read.
+func (r *Reader) SetUTF8Policy(policy UTF8Policy) {
+	r.utf8Policy = policy
+}
+
+var replacementChar = []byte(string(utf8.RuneError))
+
+// utf8Reader validates (and optionally repairs) UTF-8 a byte at a time - it implements io.ByteReader so encoding/xml
+// reads it directly instead of buffering ahead, which lets the validation be switched off precisely where the document
+// switches encodings
+type utf8Reader struct {
+	source  *bufio.Reader
+	policy  UTF8Policy
+	active  bool
+	pending []byte
+	offset  int64
+}
+
+func newUTF8Reader(source io.Reader, policy UTF8Policy) *utf8Reader {
+	return &utf8Reader{
+		source: bufio.NewReader(source),
+		policy: policy,
+		active: true,
+	}
+}
+
+func (u *utf8Reader) ReadByte() (byte, error) {
+
+	// hand out the rest of a multi-byte rune first
+	if len(u.pending) > 0 {
+		c := u.pending[0]
+		u.pending = u.pending[1:]
+		return c, nil
+	}
+
+	c, err := u.source.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	if !u.active || c < utf8.RuneSelf {
+		u.offset++
+		return c, nil
+	}
+
+	// look at the whole rune this byte starts
+	_ = u.source.UnreadByte()
+	buf, _ := u.source.Peek(utf8.UTFMax)
+	r, size := utf8.DecodeRune(buf)
+
+	if r == utf8.RuneError && size <= 1 {
+		if u.policy == UTF8Reject {
+			return 0, &UTF8Error{Offset: u.offset}
+		}
+
+		_, _ = u.source.Discard(1)
+		u.offset++
+		u.pending = append(u.pending[:0], replacementChar[1:]...)
+		return replacementChar[0], nil
+	}
+
+	c = buf[0]
+	u.pending = append(u.pending[:0], buf[1:size]...)
+	_, _ = u.source.Discard(size)
+	u.offset += int64(size)
+	return c, nil
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	for i := range p {
+		c, err := u.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = c
+	}
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+package xml
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Validate checks that the document is well-formed by streaming all of its tokens, returning the first XML error (or
+// nil) - no builder is invoked and no element bodies are decoded, making it a cheap gatekeeper for ingestion.  Since it
+// reads through the same token stream as parsing does, the charset, UTF-8 and entity settings apply just as they would
+// later, as do the reader's own checks (a single root, after SetMultiRoot(false), and SetRequiredAttributes), so a
+// document that validates will parse.  A document without a root element fails.  It consumes the input, so follow it
+// with Reset to process a document that validated.
+func (r *Reader) Validate() error {
+	for {
+		if _, err := r.token(); err != nil {
+			if err != io.EOF {
+				return err
+			}
+			if r.roots == 0 {
+				return errors.New("document has no root element")
+			}
+			return nil
+		}
+	}
+}
+
+// Reset rewinds the reader to the start of its input, so it can be read again (e.g. processed after Validate).  The
+// input must be seekable - files, and readers over an io.ReadSeeker or from NewReaderAt - or ErrNotSeekable is
+// returned.
+func (r *Reader) Reset() error {
+	seeker, ok := r.source.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.resetState()
+	atomic.StoreInt64(&r.skipped, 0)
+	r.recordCounts = nil
+	r.summaryEmitted = false
+	return nil
+}